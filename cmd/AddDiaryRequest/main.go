@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/rpcclient"
+)
+
+func main() {
+
+	slog.Info("AddDiaryRequest")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	title := flag.String("title", "", "The title of the diary")
+	timeout := flag.Duration("timeout", 10*time.Second, "How long to wait for the response")
+	flag.Parse()
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	client, err := rpcclient.Connect(ctx, config, "requester")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	r := request.New("addDiary")
+	r.PutString("title", *title)
+
+	resp, err := client.Request(ctx, r, *timeout)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Handle the response
+	if resp.Ok() {
+		diary, _ := resp.GetInteger("diary")
+		slog.Info(fmt.Sprintf("diary: %d", diary))
+	} else {
+		code, _ := resp.GetCode()
+		message, _ := resp.GetMessage()
+		slog.Warn("error response", "code", code, "message", message)
+	}
+}
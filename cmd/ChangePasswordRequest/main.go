@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/prompt"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/rpcclient"
+)
+
+func main() {
+
+	slog.Info("ChangePasswordRequest")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	timeout := flag.Duration("timeout", 10*time.Second, "How long to wait for the response")
+	flag.Parse()
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	oldPassword, err := prompt.Password("Old password")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	newPassword, err := prompt.Password("New password")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	client, err := rpcclient.Connect(ctx, config, "requester")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	r := request.New("changePassword")
+	r.PutString("oldPassword", oldPassword)
+	r.PutString("newPassword", newPassword)
+
+	resp, err := client.Request(ctx, r, *timeout)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Handle the response
+	if resp.Ok() {
+		slog.Info("password changed")
+	} else {
+		code, _ := resp.GetCode()
+		message, _ := resp.GetMessage()
+		slog.Error(fmt.Sprintf("error response: code: %d, message: %s", code, message))
+	}
+}
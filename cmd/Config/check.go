@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/connection"
+	"github.com/rsmaxwell/diaries/internal/storage"
+)
+
+// check validates the configuration, then tries each broker and the database. It exits with 1 if anything is wrong
+func check(args []string) {
+
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 10*time.Second, "How long to wait for each broker and the database")
+	flags.Parse(args)
+
+	loaded, err := config.Load()
+	if err != nil {
+		var invalid *config.ValidationError
+		if errors.As(err, &invalid) {
+			for _, problem := range invalid.Problems {
+				fmt.Printf("FAIL  %s\n", problem)
+			}
+		} else {
+			fmt.Printf("FAIL  %s\n", err)
+		}
+		os.Exit(1)
+	}
+
+	for _, filename := range loaded.Files {
+		fmt.Printf("ok    read %s\n", filename)
+	}
+	fmt.Println("ok    configuration is valid")
+
+	c := loaded.Config
+	failed := false
+
+	for _, broker := range c.Mqtt.GetBrokers() {
+		if err := checkBroker(c.Mqtt, broker, *timeout); err != nil {
+			fmt.Printf("FAIL  broker %s: %s\n", broker.GetServer(), err)
+			failed = true
+		} else {
+			fmt.Printf("ok    broker %s\n", broker.GetServer())
+		}
+	}
+
+	name := fmt.Sprintf("%s:%d/%s", c.Db.Host, c.Db.Port, c.Db.Database)
+	if c.Db.Memory() {
+		name = "in memory"
+	}
+	if err := checkDatabase(&c.Db, *timeout); err != nil {
+		fmt.Printf("FAIL  database %s: %s\n", name, err)
+		failed = true
+	} else {
+		fmt.Printf("ok    database %s\n", name)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// checkBroker connects to the one broker and logs on, without leaving a session behind
+func checkBroker(mqtt config.MqttConfig, broker config.BrokerConfig, timeout time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	mqtt.Brokers = []config.BrokerConfig{broker}
+
+	mqttConfig, err := connection.NewTransientConfig(ctx, &mqtt, "check")
+	if err != nil {
+		return err
+	}
+
+	var mutex sync.Mutex
+	var lastErr error
+	mqttConfig.OnConnectError = func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		lastErr = err
+	}
+
+	cm, err := autopaho.NewConnection(ctx, *mqttConfig)
+	if err != nil {
+		return err
+	}
+
+	if err := cm.AwaitConnection(ctx); err != nil {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if lastErr != nil {
+			return lastErr
+		}
+		return err
+	}
+
+	disconnectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = cm.Disconnect(disconnectCtx)
+	return nil
+}
+
+func checkDatabase(c *config.DBConfig, timeout time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// With the memory driver this loads the seed file
+	data, err := storage.Open(ctx, c)
+	if err != nil {
+		return err
+	}
+	return data.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+const usage = "usage: Config [--config <file>] show [--effective] | check [--timeout <duration>]"
+
+// Shows or checks the configuration the other commands would use:
+//
+//	Config [--config <file>] show [--effective]
+//	Config [--config <file>] check [--timeout <duration>]
+func main() {
+
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		slog.Error(usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "show":
+		show(args[1:])
+	case "check":
+		check(args[1:])
+	default:
+		slog.Error(usage)
+		os.Exit(2)
+	}
+}
+
+func show(args []string) {
+
+	flags := flag.NewFlagSet("show", flag.ExitOnError)
+	effective := flags.Bool("effective", false, "List every setting with the value in use and where it came from")
+	flags.Parse(args)
+
+	loaded, err := config.LoadWithoutSecrets()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if !*effective {
+		loaded.Config.Print()
+		return
+	}
+
+	for _, filename := range loaded.Files {
+		fmt.Printf("# read %s\n", filename)
+	}
+
+	for _, setting := range loaded.Effective() {
+		value, _ := json.Marshal(setting.Value)
+		source := setting.Source
+		if source == "" {
+			source = "unset, " + setting.Env
+		}
+		fmt.Printf("%-45s %-30s (%s)\n", setting.Path, value, source)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+)
+
+// Prints a new Ed25519 key pair: the private key for the signer's configuration, and the public key to add
+// to the trusted keys of whoever checks its signatures
+func main() {
+
+	slog.Info("CreateSigningKey")
+
+	err := loggerlevel.SetLoggerLevel()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	id := flag.String("id", "", "The id of the new key")
+	flag.Parse()
+
+	if *id == "" {
+		slog.Error("an id is required")
+		os.Exit(1)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// The private key is written out here on purpose, so it is not a config.Secret, which would be redacted
+	key := map[string]string{"id": *id, "privateKey": base64.StdEncoding.EncodeToString(privateKey.Seed())}
+	trusted := config.TrustedKey{ID: *id, PublicKey: base64.StdEncoding.EncodeToString(publicKey)}
+
+	for _, value := range []interface{}{key, trusted} {
+		text, _ := json.MarshalIndent(value, "", "    ")
+		fmt.Println(string(text))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+)
+
+func main() {
+
+	slog.Info("CreateToken")
+
+	subject := flag.String("subject", "", "Who the token is for")
+	role := flag.String("role", "reader", "The role granted by the token")
+	clientID := flag.String("client", "", "The client id the token is bound to, e.g. <clientId>-requester")
+	ttl := flag.Duration("ttl", time.Hour, "How long the token is valid")
+	flag.Parse()
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if *subject == "" {
+		slog.Error("a subject is required")
+		os.Exit(1)
+	}
+
+	if *clientID == "" {
+		slog.Error("a client id is required")
+		os.Exit(1)
+	}
+
+	keySet, err := auth.NewKeySet(&config.Auth)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	token, claims, err := keySet.Issue(*subject, *role, *clientID, *ttl)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	slog.Info(fmt.Sprintf("token for '%s' expires at %s", claims.Subject, time.Unix(claims.ExpiresAt, 0).Format(time.RFC3339)))
+	fmt.Println(token)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/rsmaxwell/diaries/internal/authz"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/prompt"
+	"github.com/rsmaxwell/diaries/internal/storage"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+func main() {
+
+	slog.Info("CreateUser")
+
+	username := flag.String("username", "", "The name of the new user")
+	role := flag.String("role", "reader", "The role of the new user: admin, editor, transcriber or reader")
+	flag.Parse()
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if !authz.NewPolicy(&config.Authz).Known(*role) {
+		slog.Error(fmt.Sprintf("unexpected role: %s", *role))
+		os.Exit(1)
+	}
+
+	// A user created in memory would be gone as soon as this command ends
+	if config.Db.Memory() {
+		slog.Error("the memory driver keeps nothing between runs: add the user to the seed file instead")
+		os.Exit(1)
+	}
+
+	password, err := prompt.Password("Password")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	data, err := storage.Open(context.Background(), &config.Db)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	defer data.Close()
+
+	store, err := users.NewStore(data.Users, &config.Users)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = data.Check(context.Background())
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	user, err := store.Create(*username, password, *role)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	slog.Info(fmt.Sprintf("created user '%s' (id %d) with role '%s'", user.Username, user.ID, user.Role))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/prompt"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/rpcclient"
+)
+
+func main() {
+
+	slog.Info("CreateUserRequest")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	username := flag.String("username", "", "The name of the new user")
+	role := flag.String("role", "reader", "The role of the new user: admin, editor, transcriber or reader")
+	timeout := flag.Duration("timeout", 10*time.Second, "How long to wait for the response")
+	flag.Parse()
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	password, err := prompt.Password("Password")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	client, err := rpcclient.Connect(ctx, config, "requester")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	r := request.New("createUser")
+	r.PutString("username", *username)
+	r.PutString("password", password)
+	r.PutString("role", *role)
+
+	resp, err := client.Request(ctx, r, *timeout)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Handle the response
+	if resp.Ok() {
+		slog.Info(fmt.Sprintf("created user '%s'", *username))
+	} else {
+		code, _ := resp.GetCode()
+		message, _ := resp.GetMessage()
+		slog.Error(fmt.Sprintf("error response: code: %d, message: %s", code, message))
+	}
+}
@@ -0,0 +1,177 @@
+/* see:
+ *    https://github.com/eclipse/paho.golang/blob/v0.21.0/autopaho/examples/basics/basics.go
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/connection"
+	"github.com/rsmaxwell/diaries/internal/deadletter"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+)
+
+func main() {
+
+	slog.Info("DeadLetters")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	replay := flag.String("replay", "", "The id of the dead letter to replay, or 'all'. Only requests sent without a token or signature can be replayed")
+	purge := flag.String("purge", "", "The id of the dead letter to discard, or 'all'")
+	wait := flag.Duration("wait", 2*time.Second, "How long to wait for the retained dead letters to arrive")
+	flag.Parse()
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	deadLetterTopic := config.Topics.GetTopic(config.DeadLetter.GetTopic())
+
+	var mutex sync.Mutex
+	deadLetters := map[string]*deadletter.DeadLetter{}
+
+	mqttConfig, err := connection.NewTransientConfig(ctx, &config.Mqtt, "deadletters")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	qos := config.Mqtt.GetQoS()
+
+	initialSubscriptionMade := make(chan struct{}) // Closed when subscription made
+	var initialSubscriptionOnce sync.Once          // We only want to close the above once!
+
+	mqttConfig.OnConnectionUp = func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5*time.Second))
+		defer cancel()
+
+		// Subscribing delivers every dead letter still retained on the broker
+		if _, err := cm.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{
+				{Topic: fmt.Sprintf("%s/#", deadLetterTopic), QoS: qos},
+			},
+		}); err != nil {
+			slog.Error("failed to subscribe, so no dead letters will be received", "error", err)
+			return
+		}
+		initialSubscriptionOnce.Do(func() { close(initialSubscriptionMade) })
+	}
+
+	mqttConfig.OnPublishReceived = []func(paho.PublishReceived) (bool, error){
+		func(received paho.PublishReceived) (bool, error) {
+			if len(received.Packet.Payload) == 0 {
+				return true, nil
+			}
+
+			var d deadletter.DeadLetter
+			if err := json.Unmarshal(received.Packet.Payload, &d); err != nil {
+				slog.Warn("could not decode dead letter", "topic", received.Packet.Topic, "error", err)
+				return true, nil
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			deadLetters[d.ID] = &d
+			return true, nil
+		}}
+
+	cm, err := autopaho.NewConnection(ctx, *mqttConfig)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	connCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	select {
+	case <-connCtx.Done():
+		slog.Error(fmt.Sprintf("failed to connect & subscribe: %s", connCtx.Err()))
+		os.Exit(1)
+	case <-initialSubscriptionMade:
+	}
+
+	// Give the broker time to deliver the retained messages
+	select {
+	case <-ctx.Done():
+		os.Exit(1)
+	case <-time.After(*wait):
+	}
+
+	// Dead letters may still be arriving, so work on a copy
+	mutex.Lock()
+	list := make([]*deadletter.DeadLetter, 0, len(deadLetters))
+	for _, d := range deadLetters {
+		list = append(list, d)
+	}
+	mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	for _, d := range list {
+		id := d.ID
+
+		slog.Info(fmt.Sprintf("%s  %s  %-20s %s: %s", d.ID, d.Timestamp.Format(time.RFC3339), d.Reason, d.Topic, d.Message))
+		slog.Debug(fmt.Sprintf("payload: %s", string(d.Payload)))
+
+		if (*replay == id || *replay == "all") && d.PayloadOmitted {
+			slog.Warn("cannot replay dead letter: its payload held credentials, so was not kept", "id", id)
+		} else if (*replay == id || *replay == "all") && d.CredentialsOmitted {
+			slog.Warn("cannot replay dead letter: its request had a token or signature, which was not kept", "id", id)
+		} else if *replay == id || *replay == "all" {
+			original := d.Original()
+			original.QoS = qos
+			if _, err := cm.Publish(ctx, original); err != nil {
+				slog.Error("could not replay dead letter", "id", id, "error", err)
+				continue
+			}
+			slog.Info(fmt.Sprintf("replayed dead letter %s", id))
+			discard(ctx, cm, d, deadLetterTopic, qos)
+		} else if *purge == id || *purge == "all" {
+			discard(ctx, cm, d, deadLetterTopic, qos)
+		}
+	}
+
+	slog.Info(fmt.Sprintf("%d dead letter(s)", len(list)))
+
+	disconnectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = cm.Disconnect(disconnectCtx)
+}
+
+// discard clears the retained dead letter from the broker
+func discard(ctx context.Context, cm *autopaho.ConnectionManager, d *deadletter.DeadLetter, deadLetterTopic string, qos byte) {
+	_, err := cm.Publish(ctx, &paho.Publish{
+		QoS:     qos,
+		Retain:  true,
+		Topic:   d.GetTopic(deadLetterTopic),
+		Payload: []byte{},
+	})
+	if err != nil {
+		slog.Error("could not discard dead letter", "id", d.ID, "error", err)
+		return
+	}
+	slog.Info(fmt.Sprintf("discarded dead letter %s", d.ID))
+}
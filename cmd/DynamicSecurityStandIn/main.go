@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/connection"
+	"github.com/rsmaxwell/diaries/internal/dynsec"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+)
+
+// Answers dynamic security commands on the configured topic, as the broker's plugin would, and logs the clients
+// after each change. Set dynamicSecurity.topic to a topic of its own, so the broker does not handle it
+func main() {
+
+	slog.Info("DynamicSecurityStandIn")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	flag.Parse()
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	topic := config.DynamicSecurity.GetTopic()
+	responseTopic := config.DynamicSecurity.GetResponseTopic()
+	standIn := dynsec.NewStandIn()
+
+	mqttConfig, err := connection.NewTransientConfig(ctx, &config.Mqtt, "dynsec")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	mqttConfig.OnConnectionUp = func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5*time.Second))
+		defer cancel()
+		if _, err := cm.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{
+				{Topic: topic, QoS: 1},
+			},
+		}); err != nil {
+			slog.Error("failed to subscribe, so no commands will be received", "error", err)
+			return
+		}
+		slog.Info(fmt.Sprintf("answering dynamic security commands on '%s'", topic))
+	}
+
+	mqttConfig.OnPublishReceived = []func(paho.PublishReceived) (bool, error){
+		func(received paho.PublishReceived) (bool, error) {
+
+			slog.Info(fmt.Sprintf("Received commands: %s", loggerlevel.Payload(received.Packet.Payload)))
+
+			payload, err := standIn.Handle(received.Packet.Payload)
+			if err != nil {
+				slog.Warn("could not decode commands", "error", err)
+				return true, nil
+			}
+
+			slog.Info(fmt.Sprintf("Sending responses: %s", loggerlevel.Payload(payload)))
+			if _, err := received.Client.Publish(ctx, &paho.Publish{QoS: 1, Topic: responseTopic, Payload: payload}); err != nil {
+				slog.Error("could not publish responses", "topic", responseTopic, "error", err)
+			}
+
+			state, _ := json.MarshalIndent(standIn.State(), "", "    ")
+			slog.Info(fmt.Sprintf("clients: %s", state))
+			return true, nil
+		}}
+
+	_, err = autopaho.NewConnection(ctx, *mqttConfig)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	<-ctx.Done()
+	slog.Info("Quitting")
+}
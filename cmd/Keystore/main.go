@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/prompt"
+)
+
+// Keeps secrets in the encrypted keystore, where the configuration can refer to them as "keystore:<name>":
+//
+//	Keystore [--config <file>] list
+//	Keystore [--config <file>] set <name>
+//	Keystore [--config <file>] remove <name>
+func main() {
+
+	flag.Parse()
+
+	loaded, err := config.LoadWithoutSecrets()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&loaded.Config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 || (args[0] != "list" && len(args) != 2) {
+		slog.Error("usage: Keystore list | set <name> | remove <name>")
+		os.Exit(2)
+	}
+
+	ks, err := config.OpenKeystore(&loaded.Config.Keystore)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		for _, name := range ks.Names() {
+			fmt.Println(name)
+		}
+		return
+
+	case "set":
+		value, err := prompt.Password("Value")
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		ks.Set(args[1], value)
+
+	case "remove":
+		ks.Remove(args[1])
+
+	default:
+		slog.Error(fmt.Sprintf("unexpected command: %s", args[0]))
+		os.Exit(2)
+	}
+
+	err = ks.Save()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	slog.Info(fmt.Sprintf("%s: %s", args[0], args[1]))
+}
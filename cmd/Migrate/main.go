@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/database"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/migrations"
+)
+
+const usage = "usage: Migrate [--config <file>] up [<version>] | down <version> | status | repair"
+
+// Changes the database schema with the migrations built into the command:
+//
+//	Migrate up [<version>]   apply the pending migrations, up to the version if given
+//	Migrate down <version>   undo the migrations above the version, 0 to undo them all
+//	Migrate status           list the migrations and whether each has been applied
+//	Migrate repair           accept the changes made to migrations which were already applied
+func main() {
+
+	slog.Info("Migrate")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		slog.Error(usage)
+		os.Exit(2)
+	}
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if config.Db.Memory() {
+		slog.Error("the memory driver has no schema to migrate")
+		os.Exit(1)
+	}
+
+	db, err := database.Connect(ctx, &config.Db)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	switch {
+	case args[0] == "up" && len(args) <= 2:
+		target := 0
+		if len(args) == 2 {
+			target = version(args[1])
+		}
+		done, err := migrations.Up(ctx, db, target)
+		report("applied", done, err)
+
+	case args[0] == "down" && len(args) == 2:
+		done, err := migrations.Down(ctx, db, version(args[1]))
+		report("undone", done, err)
+
+	case args[0] == "status" && len(args) == 1:
+		list, err := migrations.GetStatus(ctx, db)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		for _, s := range list {
+			state := "pending"
+			if s.Applied != nil {
+				state = "applied " + s.Applied.Local().Format("2006-01-02 15:04:05")
+			}
+			if s.Modified {
+				state += ", changed since"
+			}
+			if !s.Embedded {
+				state += ", unknown to this build"
+			}
+			fmt.Printf("%4d  %-30s %s\n", s.Version, s.Name, state)
+		}
+
+	case args[0] == "repair" && len(args) == 1:
+		done, err := migrations.Repair(ctx, db)
+		report("repaired", done, err)
+
+	default:
+		slog.Error(usage)
+		os.Exit(2)
+	}
+}
+
+func version(text string) int {
+	v, err := strconv.Atoi(text)
+	if err != nil || v < 0 {
+		slog.Error(fmt.Sprintf("unexpected version: %s", text))
+		os.Exit(2)
+	}
+	return v
+}
+
+func report(action string, versions []int, err error) {
+	for _, v := range versions {
+		slog.Info(fmt.Sprintf("%s migration %d", action, v))
+	}
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if len(versions) == 0 {
+		slog.Info(fmt.Sprintf("nothing %s", action))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/mosquitto"
+	"github.com/rsmaxwell/diaries/internal/storage"
+	"github.com/rsmaxwell/diaries/internal/users"
+
+	_ "github.com/lib/pq"
+)
+
+// Generates the Mosquitto password_file and acl_file from the diaries users. The Responder's account comes from
+// the mqtt settings of the configuration
+func main() {
+
+	slog.Info("MosquittoFiles")
+
+	passwordFile := flag.String("passwords", "", "The password_file to write, or standard output if not given")
+	aclFile := flag.String("acl", "", "The acl_file to write, or standard output if not given")
+	flag.Parse()
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	data, err := storage.Open(context.Background(), &config.Db)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	defer data.Close()
+
+	store, err := users.NewStore(data.Users, &config.Users)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = data.Check(context.Background())
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	list, err := store.List()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	passwords, acl := generate(config, list, time.Now())
+
+	err = write(*passwordFile, passwords, 0600)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = write(*aclFile, acl, 0644)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// generate returns the password file and the acl file for the users and the Responder's own account, which is the
+// broker user of the mqtt settings, whether there is one broker or several. Users whose account is locked are left
+// out, so they cannot use the broker until the files are generated again after the lock ends
+func generate(c *config.Config, list []users.User, now time.Time) ([]byte, []byte) {
+
+	responder := c.Mqtt.GetUsername()
+
+	hashes := make(map[string]string)
+	accounts := []mosquitto.Account{}
+	for _, user := range list {
+		if user.Username == responder {
+			slog.Warn("user has the same name as the Responder's broker account, and is left out", "username", user.Username)
+			continue
+		}
+		if user.Locked(now) {
+			slog.Info("user is locked, and is left out", "username", user.Username, "until", *user.LockedUntil)
+			continue
+		}
+		accounts = append(accounts, mosquitto.Account{Username: user.Username, Role: user.Role})
+		if user.BrokerPasswordHash == "" {
+			slog.Warn("user has no broker password yet, until their password is changed", "username", user.Username)
+			continue
+		}
+		hashes[user.Username] = user.BrokerPasswordHash
+	}
+
+	if password := c.Mqtt.GetPassword(); password != "" {
+		hashes[responder] = mosquitto.HashPassword(password, mosquitto.DerivedSalt(responder, password))
+	}
+
+	return mosquitto.PasswordFile(hashes), mosquitto.ACLFile(responder, accounts, mosquitto.NewTopics(c))
+}
+
+func write(filename string, content []byte, mode os.FileMode) error {
+	if filename == "" {
+		_, err := os.Stdout.Write(content)
+		return err
+	}
+	slog.Info(fmt.Sprintf("writing %s", filename))
+	return os.WriteFile(filename, content, mode)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/mosquitto"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+func TestGenerateResponder(t *testing.T) {
+
+	responder := config.BrokerConfig{Host: "localhost", Port: 1883, Username: "responder", Password: config.NewSecret("secret")}
+
+	tests := []struct {
+		name string
+		mqtt config.MqttConfig
+	}{
+		{name: "one broker", mqtt: config.MqttConfig{BrokerConfig: responder}},
+		{name: "brokers", mqtt: config.MqttConfig{Brokers: []config.BrokerConfig{responder, {Host: "backup", Port: 1883, Username: "responder", Password: config.NewSecret("secret")}}}},
+	}
+
+	list := []users.User{{ID: 1, Username: "alice", Role: "reader", BrokerPasswordHash: "$7$101$salt$hash"}}
+	want := "responder:" + mosquitto.HashPassword("secret", mosquitto.DerivedSalt("responder", "secret")) + "\n"
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			passwords, acl := generate(&config.Config{Mqtt: tt.mqtt}, list, time.Now())
+
+			if !strings.Contains(string(passwords), want) {
+				t.Errorf("the password file has no line for the Responder:\n%s", passwords)
+			}
+			if !strings.Contains(string(passwords), "alice:") {
+				t.Errorf("the password file has no line for alice:\n%s", passwords)
+			}
+			if !strings.Contains(string(acl), "user responder\n") {
+				t.Errorf("the acl file has no section for the Responder:\n%s", acl)
+			}
+		})
+	}
+}
+
+func TestGenerateLocked(t *testing.T) {
+
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+
+	tests := []struct {
+		name        string
+		lockedUntil *time.Time
+		want        bool
+	}{
+		{name: "not locked", want: true},
+		{name: "lock has run out", lockedUntil: &past, want: true},
+		{name: "locked", lockedUntil: &future, want: false},
+		{name: "locked indefinitely", lockedUntil: &users.Indefinitely, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			list := []users.User{{ID: 1, Username: "alice", Role: "reader", BrokerPasswordHash: "$7$101$salt$hash", LockedUntil: tt.lockedUntil}}
+			passwords, acl := generate(&config.Config{}, list, now)
+
+			if got := strings.Contains(string(passwords), "alice:"); got != tt.want {
+				t.Errorf("alice in the password file = %v, want %v", got, tt.want)
+			}
+			if got := strings.Contains(string(acl), "user alice\n"); got != tt.want {
+				t.Errorf("alice in the acl file = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
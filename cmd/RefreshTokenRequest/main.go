@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/rpcclient"
+)
+
+func main() {
+
+	slog.Info("RefreshTokenRequest")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	timeout := flag.Duration("timeout", 10*time.Second, "How long to wait for the response")
+	flag.Parse()
+
+	config, err := config.Read()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	refreshToken, err := rpcclient.LoadRefreshToken()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if refreshToken == "" {
+		slog.Error("not logged in")
+		os.Exit(1)
+	}
+
+	client, err := rpcclient.Connect(ctx, config, "requester")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// The saved token may have expired, and is not needed to refresh it
+	client.SetToken("")
+
+	r := request.New("refreshToken")
+	r.PutString("refreshToken", refreshToken)
+
+	resp, err := client.Request(ctx, r, *timeout)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Handle the response
+	if resp.Ok() {
+		accessToken, _ := resp.GetString("accessToken")
+		refreshToken, _ := resp.GetString("refreshToken")
+		expiresAt, _ := resp.GetString("expiresAt")
+		if err := rpcclient.SaveTokens(accessToken, refreshToken); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		slog.Info(fmt.Sprintf("refreshed, token expires at %s", expiresAt))
+	} else {
+		code, _ := resp.GetCode()
+		message, _ := resp.GetMessage()
+		slog.Error(fmt.Sprintf("error response: code: %d, message: %s", code, message))
+	}
+}
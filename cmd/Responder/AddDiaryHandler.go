@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+)
+
+type AddDiaryHandler struct {
+}
+
+func (h *AddDiaryHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("AddDiaryHandler")
+
+	title, err := req.GetString("title")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'title' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	id, err := diaryStore.AddDiary(auth.PrincipalFrom(ctx), title)
+	if err != nil {
+		return response.BadRequest(err.Error()), false, nil
+	}
+
+	audit.Record("diary-added", auth.ClientIDFrom(ctx), req.Function, fmt.Sprintf("diary: %d", id))
+
+	resp := response.New(http.StatusOK)
+	resp.PutInteger("diary", id)
+	return resp, false, nil
+}
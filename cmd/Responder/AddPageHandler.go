@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/diaries"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+)
+
+type AddPageHandler struct {
+}
+
+func (h *AddPageHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("AddPageHandler")
+
+	diary, err := req.GetInteger("diary")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'diary' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	title, err := req.GetString("title")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'title' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	page, err := diaryStore.AddPage(auth.PrincipalFrom(ctx), diary, title)
+	if errors.Is(err, diaries.ErrForbidden) {
+		return forbidden(ctx, req.Function, fmt.Sprintf("diary %d: %s", diary, err)), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp := response.New(http.StatusOK)
+	resp.PutObject("page", page)
+	return resp, false, nil
+}
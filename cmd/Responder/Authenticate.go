@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+// anonymousBucket is the rate limit bucket shared by every request without a valid token, so a caller cannot get
+// a fresh bucket by changing something it chooses itself
+const anonymousBucket = "anonymous"
+
+// identify verifies the bearer token of the request. A request without a token has no claims. A token is only
+// accepted from the client it was issued to, which is then the client the request is from, so a token without a
+// client id is refused. It only checks the token, so it is cheap enough to do before the rate limits
+func identify(c *call) (*auth.Claims, error) {
+
+	if c.token == "" {
+		return nil, nil
+	}
+
+	claims, err := current().keySet.Verify(c.token)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ClientID == "" {
+		return nil, fmt.Errorf("token is not bound to a client")
+	}
+	if claims.ClientID != c.clientID {
+		return nil, fmt.Errorf("token was issued to a different client")
+	}
+
+	return claims, nil
+}
+
+// bucket is the key of the caller's client rate limit: the subject of a verified token, or else the bucket shared
+// by anonymous callers
+func bucket(claims *auth.Claims) string {
+	if claims == nil {
+		return anonymousBucket
+	}
+	return "user:" + claims.Subject
+}
+
+// authenticate attaches the caller identified by the token to the context passed to the handler, once its
+// session has been checked. A request without a token is refused unless the function is public or authentication
+// is not required
+func authenticate(ctx context.Context, req *request.Request, claims *auth.Claims) (context.Context, error) {
+
+	if claims == nil {
+		if current().authRequired && !publicFunctions[req.Function] {
+			return ctx, fmt.Errorf("authentication required")
+		}
+		return ctx, nil
+	}
+
+	principal := &auth.Principal{
+		Subject:  claims.Subject,
+		Role:     claims.Role,
+		ClientID: claims.ClientID,
+		Claims:   claims,
+	}
+
+	// The role of a user who has logged in is looked up on every call, so a change of role applies at once rather
+	// than when the token expires. Tokens made with CreateToken have no session, and keep the role they were given
+	if claims.SessionID != "" {
+		session, err := current().userStore.Session(claims.SessionID)
+		if errors.Is(err, users.ErrInvalidSession) {
+			return ctx, fmt.Errorf("session has ended")
+		}
+		if err != nil {
+			return ctx, err
+		}
+		if session.Username != claims.Subject {
+			return ctx, fmt.Errorf("session is not the token's")
+		}
+		principal.Role = session.Role
+	}
+
+	return auth.WithPrincipal(ctx, principal), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/authz"
+	"github.com/rsmaxwell/diaries/internal/response"
+)
+
+// authorize checks the caller's role allows the function. Callers without a token have the anonymous role
+func authorize(ctx context.Context, function string) *response.Response {
+
+	if publicFunctions[function] {
+		return nil
+	}
+
+	role := authz.Anonymous
+	if principal := auth.PrincipalFrom(ctx); principal != nil {
+		role = principal.Role
+	}
+
+	if !current().policy.Allowed(role, function) {
+		return forbidden(ctx, function, fmt.Sprintf("role '%s' may not call '%s'", role, function))
+	}
+	return nil
+}
+
+// forbidden records the denial in the audit log and returns a 403 response
+func forbidden(ctx context.Context, function string, message string) *response.Response {
+
+	detail := message
+	if principal := auth.PrincipalFrom(ctx); principal != nil {
+		detail = fmt.Sprintf("subject: %s: %s", principal.Subject, message)
+	}
+
+	audit.Record("forbidden", auth.ClientIDFrom(ctx), function, detail)
+	return response.Forbidden(message)
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log/slog"
+	"context"
 	"net/http"
 
 	"github.com/rsmaxwell/diaries/internal/buildinfo"
@@ -12,8 +12,8 @@ import (
 type BuildInfoHandler struct {
 }
 
-func (h *BuildInfoHandler) Handle(req request.Request) (*response.Response, bool, error) {
-	slog.Debug("BuildInfoHandler")
+func (h *BuildInfoHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("BuildInfoHandler")
 
 	info := buildinfo.NewBuildInfo()
 
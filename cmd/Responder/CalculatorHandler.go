@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"log/slog"
 	"net/http"
 
 	"github.com/rsmaxwell/diaries/internal/request"
@@ -13,8 +13,8 @@ import (
 type CalculatorHandler struct {
 }
 
-func (h *CalculatorHandler) Handle(req request.Request) (resp *response.Response, quit bool, err error) {
-	slog.Debug("CalculatorHandler")
+func (h *CalculatorHandler) Handle(ctx context.Context, req request.Request) (resp *response.Response, quit bool, err error) {
+	handlerLog.Debug("CalculatorHandler")
 
 	operation, err := req.GetString("operation")
 	if err != nil {
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+type ChangePasswordHandler struct {
+}
+
+func (h *ChangePasswordHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("ChangePasswordHandler")
+
+	principal := auth.PrincipalFrom(ctx)
+	if principal == nil {
+		return response.Unauthorized("not logged in"), false, nil
+	}
+
+	oldPassword, err := req.GetString("oldPassword")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'oldPassword' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	newPassword, err := req.GetString("newPassword")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'newPassword' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	err = current().userStore.ChangePassword(principal.Subject, oldPassword, newPassword, principal.Claims.SessionID)
+	if errors.Is(err, users.ErrInvalidCredentials) || errors.Is(err, users.ErrLocked) {
+		audit.Record("change-password-failed", principal.ClientID, req.Function, principal.Subject)
+		return response.Unauthorized(err.Error()), false, nil
+	}
+	if err != nil {
+		return response.BadRequest(err.Error()), false, nil
+	}
+
+	audit.Record("password-changed", principal.ClientID, req.Function, principal.Subject)
+
+	err = brokerClients.SetPassword(ctx, principal.Subject, newPassword)
+	if err != nil {
+		handlerLog.Warn("could not change the password of broker client", "username", principal.Subject, "error", err)
+	}
+
+	resp := response.New(http.StatusOK)
+	return resp, false, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+)
+
+type CreateUserHandler struct {
+}
+
+func (h *CreateUserHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("CreateUserHandler")
+
+	username, err := req.GetString("username")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'username' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	password, err := req.GetString("password")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'password' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	role, err := req.GetString("role")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'role' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	if !current().policy.Known(role) {
+		return response.BadRequest(fmt.Sprintf("unexpected role: %s", role)), false, nil
+	}
+
+	user, err := current().userStore.Create(username, password, role)
+	if err != nil {
+		return response.BadRequest(err.Error()), false, nil
+	}
+
+	audit.Record("user-created", auth.ClientIDFrom(ctx), req.Function, fmt.Sprintf("username: %s, role: %s", username, role))
+
+	err = brokerClients.CreateClient(ctx, username, password, role)
+	if err != nil {
+		resp := response.New(http.StatusBadGateway)
+		resp.PutMessage(fmt.Sprintf("user '%s' was created, but their broker client was not: %s", username, err))
+		return resp, false, nil
+	}
+
+	resp := response.New(http.StatusOK)
+	resp.PutInteger("id", user.ID)
+	return resp, false, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/deadletter"
+	"github.com/rsmaxwell/diaries/internal/encryption"
+	"github.com/rsmaxwell/diaries/internal/ratelimit"
+	"github.com/rsmaxwell/diaries/internal/stats"
+)
+
+var (
+	deadLetterLimiter *ratelimit.Limiter // So a flood of bad requests cannot fill the broker's retained store
+	deadLetterExpiry  uint32             // Seconds the broker keeps each dead letter, 0 for no expiry
+)
+
+// credentialFunctions are the functions whose arguments hold passwords or refresh tokens
+var credentialFunctions = map[string]bool{
+	"login":          true,
+	"refreshToken":   true,
+	"changePassword": true,
+	"createUser":     true,
+}
+
+// deadLetter republishes a request which could not be answered to the dead-letter topic. Each dead
+// letter is retained on its own sub-topic, so they remain on the broker until they are replayed, purged or expire.
+// The payload is the decrypted request, or nil if it was not decrypted
+func deadLetter(ctx context.Context, received paho.PublishReceived, payload []byte, reason deadletter.Reason, message string) {
+
+	mqttLog.Warn("dead letter", "reason", reason, "message", message)
+	stats.Increment("deadLetters")
+
+	if ok, _ := deadLetterLimiter.Allow("deadLetters"); !ok {
+		stats.Increment("deadLetters.dropped")
+		return
+	}
+
+	d := deadletter.New(received.Packet, reason, message, keepPayload(received.Packet, payload))
+
+	body, err := json.Marshal(d)
+	if err != nil {
+		mqttLog.Error("could not marshal dead letter", "reason", reason, "error", err)
+		return
+	}
+
+	publish := &paho.Publish{
+		QoS:     qos,
+		Retain:  true,
+		Topic:   d.GetTopic(deadLetterTopic),
+		Payload: body,
+	}
+	if deadLetterExpiry > 0 {
+		publish.Properties = &paho.PublishProperties{MessageExpiry: &deadLetterExpiry}
+	}
+
+	_, err = received.Client.Publish(ctx, publish)
+	if err != nil {
+		mqttLog.Error("could not publish dead letter", "topic", publish.Topic, "error", err)
+	}
+}
+
+// keepPayload reports whether a dead letter may keep the request's payload. The payloads of the functions which
+// carry passwords or refresh tokens, and of requests with a bearer token inside, are left out. A payload which
+// was not decrypted is kept, as it is of no use without the key
+func keepPayload(packet *paho.Publish, payload []byte) bool {
+
+	if payload == nil {
+		if encryption.Encrypted(packet.Properties) {
+			return true
+		}
+		payload = packet.Payload
+	}
+
+	var envelope struct {
+		Function string `json:"function"`
+		Token    string `json:"token"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return true
+	}
+	return !credentialFunctions[envelope.Function] && envelope.Token == ""
+}
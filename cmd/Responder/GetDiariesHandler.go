@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+)
+
+type GetDiariesHandler struct {
+}
+
+func (h *GetDiariesHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("GetDiariesHandler")
+
+	list, err := diaryStore.List(auth.PrincipalFrom(ctx))
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp := response.New(http.StatusOK)
+	resp.PutObject("diaries", list)
+	return resp, false, nil
+}
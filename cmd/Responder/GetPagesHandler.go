@@ -1,9 +1,13 @@
 package main
 
 import (
-	"log/slog"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/diaries"
 	"github.com/rsmaxwell/diaries/internal/request"
 	"github.com/rsmaxwell/diaries/internal/response"
 )
@@ -11,10 +15,25 @@ import (
 type GetPagesHandler struct {
 }
 
-func (h *GetPagesHandler) Handle(req request.Request) (*response.Response, bool, error) {
-	slog.Debug("GetPagesHandler")
+func (h *GetPagesHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("GetPagesHandler")
+
+	diary, err := req.GetInteger("diary")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'diary' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	list, err := diaryStore.Pages(auth.PrincipalFrom(ctx), diary)
+	if errors.Is(err, diaries.ErrForbidden) {
+		return forbidden(ctx, req.Function, fmt.Sprintf("diary %d: %s", diary, err)), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
 
 	resp := response.New(http.StatusOK)
-	resp.PutString("result", "[ 'one', 'two', 'three' ]")
+	resp.PutObject("pages", list)
 	return resp, false, nil
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+type LockUserHandler struct {
+}
+
+// Handle locks the account until it is unlocked, or unlocks it
+func (h *LockUserHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("LockUserHandler")
+
+	username, err := req.GetString("username")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'username' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	locked, err := req.GetBoolean("locked")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'locked' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	var until *time.Time
+	if locked {
+		until = &users.Indefinitely
+	}
+
+	err = current().userStore.Lock(username, until)
+	if errors.Is(err, users.ErrNotFound) {
+		resp := response.New(http.StatusNotFound)
+		resp.PutMessage(fmt.Sprintf("user '%s' not found", username))
+		return resp, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if locked {
+		audit.Record("user-locked", auth.ClientIDFrom(ctx), req.Function, username)
+		disableBrokerClient(ctx, username, users.Indefinitely)
+	} else {
+		audit.Record("user-unlocked", auth.ClientIDFrom(ctx), req.Function, username)
+		cancelEnable(username)
+		err = brokerClients.Enable(ctx, username)
+		if err != nil {
+			resp := response.New(http.StatusBadGateway)
+			resp.PutMessage(fmt.Sprintf("user '%s' was unlocked, but their broker client was not: %s", username, err))
+			return resp, false, nil
+		}
+	}
+
+	resp := response.New(http.StatusOK)
+	return resp, false, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+type LoginHandler struct {
+}
+
+func (h *LoginHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("LoginHandler")
+
+	username, err := req.GetString("username")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'username' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	password, err := req.GetString("password")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'password' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	clientID := auth.ClientIDFrom(ctx)
+
+	user, err := current().userStore.Authenticate(username, password)
+	if errors.Is(err, users.ErrLocked) {
+		audit.Record("login-locked", clientID, req.Function, username)
+
+		// Only the failure which locks the account disables the broker client, so failed logins on an account which
+		// is already locked cannot keep its user off the broker
+		if errors.Is(err, users.ErrTooManyFailures) {
+			if user, err := current().userStore.Get(username); err == nil && user.LockedUntil != nil {
+				disableBrokerClient(ctx, username, *user.LockedUntil)
+			}
+		}
+		resp := response.New(http.StatusLocked)
+		resp.PutMessage(users.ErrLocked.Error())
+		return resp, false, nil
+	}
+	if errors.Is(err, users.ErrInvalidCredentials) {
+		audit.Record("login-failed", clientID, req.Function, username)
+		return response.Unauthorized(err.Error()), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	session, refreshToken, err := current().userStore.CreateSession(user, clientID, current().refreshTokenExpiry)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return sessionResponse(session, refreshToken)
+}
+
+// sessionResponse issues an access token for the session, to go with its refresh token
+func sessionResponse(session *users.Session, refreshToken string) (*response.Response, bool, error) {
+
+	accessToken, claims, err := current().keySet.IssueForSession(session.Username, session.Role, session.ClientID, session.ID, current().accessTokenExpiry)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp := response.New(http.StatusOK)
+	resp.PutString("accessToken", accessToken)
+	resp.PutString("refreshToken", refreshToken)
+	resp.PutString("expiresAt", time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	return resp, false, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+)
+
+type LogoutHandler struct {
+}
+
+func (h *LogoutHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("LogoutHandler")
+
+	principal := auth.PrincipalFrom(ctx)
+	if principal == nil || principal.Claims.SessionID == "" {
+		return response.Unauthorized("not logged in"), false, nil
+	}
+
+	err := current().userStore.Revoke(principal.Claims.SessionID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp := response.New(http.StatusOK)
+	return resp, false, nil
+}
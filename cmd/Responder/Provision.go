@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+// reenable holds, for each locked user, the timer which enables their broker client again when the lock runs out.
+// There is only ever one timer for a user, however often their lock is seen
+var reenable = struct {
+	sync.Mutex
+	timers map[string]*time.Timer
+}{timers: map[string]*time.Timer{}}
+
+// reconcileBrokerClients makes the broker's clients match the users table, after connecting. Each user's client has
+// just the broker role of their role and is enabled unless their account is locked, and the clients of users which
+// no longer exist are deleted. Clients can only be created when the password is known, so users without a client
+// are reported rather than fixed. The clients are fetched, and changed, in one round trip each, and clients which
+// are already right are not changed
+func reconcileBrokerClients(ctx context.Context) {
+
+	err := brokerClients.EnsureRoles(ctx, current().policy.Roles(), brokerTopics)
+	if err != nil {
+		mqttLog.Error("could not provision the broker roles", "error", err)
+		return
+	}
+
+	list, err := current().userStore.List()
+	if err != nil {
+		mqttLog.Error("could not list the users", "error", err)
+		return
+	}
+
+	clients, err := brokerClients.ListClients(ctx)
+	if err != nil {
+		mqttLog.Error("could not list the broker clients", "error", err)
+		return
+	}
+
+	// Only clients with a diaries role were made for users, so the Responder's own client and any others are left
+	known := make(map[string]bool)
+	usernames := []string{}
+	for _, user := range list {
+		known[user.Username] = true
+		usernames = append(usernames, user.Username)
+	}
+	responder := current().config.Mqtt.GetUsername()
+	for _, username := range clients {
+		if !known[username] && username != responder {
+			usernames = append(usernames, username)
+		}
+	}
+
+	infos, err := brokerClients.GetClients(ctx, usernames)
+	if err != nil {
+		mqttLog.Error("could not get the broker clients", "error", err)
+		return
+	}
+
+	batch := brokerClients.NewBatch()
+	now := time.Now()
+	for _, user := range list {
+
+		client := infos[user.Username]
+		if client == nil {
+			mqttLog.Warn("user has no broker client until they are created again", "username", user.Username)
+			continue
+		}
+
+		batch.SetRole(client, user.Role)
+		if user.Locked(now) {
+			if !client.Disabled {
+				batch.Disable(user.Username)
+			}
+			enableWhenUnlocked(ctx, user.Username, *user.LockedUntil)
+		} else if client.Disabled {
+			batch.Enable(user.Username)
+		}
+	}
+
+	for username, client := range infos {
+		if !known[username] && brokerClients.Managed(client) {
+			batch.Delete(username)
+			mqttLog.Info("deleting broker client, which has no user", "username", username)
+		}
+	}
+
+	if err := batch.Execute(ctx); err != nil {
+		mqttLog.Warn("could not bring the broker clients into line with the users", "changes", batch.Len(), "error", err)
+	}
+}
+
+// disableBrokerClient disables the user's broker client while their account is locked, and enables it again when
+// the lock runs out, unless the account has been locked again in the meantime
+func disableBrokerClient(ctx context.Context, username string, until time.Time) {
+
+	if brokerClients == nil {
+		return
+	}
+
+	if err := brokerClients.Disable(ctx, username); err != nil {
+		mqttLog.Warn("could not disable broker client", "username", username, "error", err)
+		return
+	}
+
+	enableWhenUnlocked(ctx, username, until)
+}
+
+// enableWhenUnlocked sets the user's timer to enable their broker client when the lock runs out, replacing any
+// timer they already have. An indefinite lock has no timer
+func enableWhenUnlocked(ctx context.Context, username string, until time.Time) {
+
+	reenable.Lock()
+	defer reenable.Unlock()
+
+	if timer := reenable.timers[username]; timer != nil {
+		timer.Stop()
+		delete(reenable.timers, username)
+	}
+
+	if until.Equal(users.Indefinitely) {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(until), func() {
+
+		reenable.Lock()
+		if reenable.timers[username] == timer {
+			delete(reenable.timers, username)
+		}
+		reenable.Unlock()
+
+		user, err := current().userStore.Get(username)
+		if err != nil || user.Locked(time.Now()) {
+			return
+		}
+		if err := brokerClients.Enable(ctx, username); err != nil {
+			mqttLog.Warn("could not enable broker client", "username", username, "error", err)
+		}
+	})
+	reenable.timers[username] = timer
+}
+
+// cancelEnable stops the user's timer, when their client is enabled early
+func cancelEnable(username string) {
+
+	reenable.Lock()
+	defer reenable.Unlock()
+
+	if timer := reenable.timers[username]; timer != nil {
+		timer.Stop()
+		delete(reenable.timers, username)
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log/slog"
 	"net/http"
 
 	"github.com/rsmaxwell/diaries/internal/request"
@@ -12,8 +12,8 @@ import (
 type QuitHandler struct {
 }
 
-func (h *QuitHandler) Handle(req request.Request) (*response.Response, bool, error) {
-	slog.Debug("QuitHandler")
+func (h *QuitHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("QuitHandler")
 
 	quit, err := req.GetBoolean("quit")
 	if err != nil {
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+type RefreshTokenHandler struct {
+}
+
+func (h *RefreshTokenHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("RefreshTokenHandler")
+
+	refreshToken, err := req.GetString("refreshToken")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'refreshToken' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	session, refreshToken, err := current().userStore.Refresh(refreshToken, current().refreshTokenExpiry)
+	if errors.Is(err, users.ErrInvalidSession) {
+		audit.Record("refresh-failed", auth.ClientIDFrom(ctx), req.Function, err.Error())
+		return response.Unauthorized(err.Error()), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return sessionResponse(session, refreshToken)
+}
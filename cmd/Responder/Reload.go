@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/authz"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/encryption"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/ratelimit"
+	"github.com/rsmaxwell/diaries/internal/signing"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+// settings are the parts of the Responder which can be changed by a reload, without a restart. A reload
+// replaces them all at once
+type settings struct {
+	config *config.Config // The configuration the settings were made from
+
+	keySet       *auth.KeySet
+	authRequired bool
+	policy       *authz.Policy
+	keyring      *encryption.Keyring
+	signer       *signing.Signer // Signs replies, when signReplies is set
+	registry     *signing.Registry
+
+	clientLimiter      *ratelimit.Limiter
+	functionLimiter    *ratelimit.Limiter
+	functionPriorities map[string]string
+	aging              time.Duration
+	queueSize          int
+
+	userStore          *users.Store
+	accessTokenExpiry  time.Duration
+	refreshTokenExpiry time.Duration
+}
+
+// restartPaths are the settings which are only read when the Responder starts
+var restartPaths = []string{"mqtt", "topics", "db", "deadLetter", "audit", "keystore", "dynamicSecurity", "scheduler.workers"}
+
+var (
+	live        atomic.Pointer[settings]
+	started     *config.Config // The configuration the Responder started with
+	reloadMutex sync.Mutex
+)
+
+func current() *settings {
+	return live.Load()
+}
+
+// newSettings makes the settings from the configuration. Where a section is unchanged from the previous
+// settings, its rate limiters and signature nonces are kept
+func newSettings(c *config.Config, previous *settings) (*settings, error) {
+
+	var err error
+	s := &settings{config: c}
+
+	s.keySet, err = auth.NewKeySet(&c.Auth)
+	if err != nil {
+		return nil, err
+	}
+	s.authRequired = c.Auth.Required
+	s.policy = authz.NewPolicy(&c.Authz)
+
+	s.keyring, err = encryption.NewKeyring(&c.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	if previous != nil && reflect.DeepEqual(previous.config.Signing, c.Signing) {
+		s.registry = previous.registry
+	} else {
+		s.registry, err = signing.NewRegistry(&c.Signing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Signing.SignReplies {
+		s.signer, err = signing.NewSigner(&c.Signing)
+		if err != nil {
+			return nil, err
+		}
+		if s.signer == nil {
+			return nil, fmt.Errorf("signReplies is set, but there is no signing key")
+		}
+	}
+
+	if previous != nil && reflect.DeepEqual(previous.config.RateLimits, c.RateLimits) {
+		s.clientLimiter = previous.clientLimiter
+		s.functionLimiter = previous.functionLimiter
+	} else {
+		s.clientLimiter = ratelimit.New(c.RateLimits.Client, nil, c.RateLimits.GetMaxClients())
+		s.functionLimiter = ratelimit.New(c.RateLimits.Function, c.RateLimits.Functions, 0)
+	}
+
+	s.functionPriorities = c.Scheduler.Priorities
+	s.queueSize = c.Scheduler.GetQueueSize()
+	s.aging, err = c.Scheduler.GetAging()
+	if err != nil {
+		return nil, err
+	}
+
+	s.userStore, err = users.NewStore(data.Users, &c.Users)
+	if err != nil {
+		return nil, err
+	}
+
+	s.accessTokenExpiry, err = c.Users.GetAccessTokenExpiry()
+	if err != nil {
+		return nil, err
+	}
+
+	s.refreshTokenExpiry, err = c.Users.GetRefreshTokenExpiry()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reloaded says which settings a reload changed, and which changes wait for a restart
+type Reloaded struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// reload reads the configuration again and applies what it can. If the new configuration is not valid
+// nothing is changed, and the Responder carries on as it was
+func reload() (*Reloaded, error) {
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	c, err := config.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Reloaded{Applied: []string{}, RestartRequired: []string{}}
+	for _, path := range config.Changed(started, c) {
+		if needsRestart(path) {
+			result.RestartRequired = append(result.RestartRequired, path)
+		}
+	}
+
+	// The settings which are only read at start keep the values the Responder is running with, as some of them,
+	// such as mqtt, are still read after a reload
+	previous := current()
+	config.Keep(c, previous.config, restartPaths)
+
+	s, err := newSettings(c, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Applied = append(result.Applied, config.Changed(previous.config, c)...)
+
+	// Any levels changed by a setLogLevel request go back to the configured ones
+	err = loggerlevel.Configure(&c.Logging)
+	if err != nil {
+		return nil, err
+	}
+
+	live.Store(s)
+	requestScheduler.SetAging(s.aging)
+	requestScheduler.SetCapacity(s.queueSize)
+
+	if brokerClients != nil && !reflect.DeepEqual(previous.config.Authz, c.Authz) {
+		go reconcileBrokerClients(context.Background())
+	}
+
+	return result, nil
+}
+
+func needsRestart(path string) bool {
+	for _, prefix := range restartPaths {
+		if path == prefix || strings.HasPrefix(path, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadOnSignal reloads whenever a signal arrives on the channel
+func reloadOnSignal(signals <-chan os.Signal) {
+	for range signals {
+		result, err := reload()
+		if err != nil {
+			slog.Error("reload failed, carrying on with the current configuration", "error", err)
+			continue
+		}
+		logReloaded(result)
+	}
+}
+
+func logReloaded(result *Reloaded) {
+	slog.Info("configuration reloaded", "applied", result.Applied)
+	if len(result.RestartRequired) > 0 {
+		slog.Warn("changes which need a restart", "paths", result.RestartRequired)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+)
+
+type ReloadHandler struct {
+}
+
+func (h *ReloadHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("ReloadHandler")
+
+	result, err := reload()
+	if err != nil {
+		handlerLog.Error("reload failed, carrying on with the current configuration", "error", err)
+		resp := response.New(http.StatusUnprocessableEntity)
+		resp.PutMessage(fmt.Sprintf("the configuration was not reloaded: %s", err))
+		return resp, false, nil
+	}
+	logReloaded(result)
+	audit.Record("reloaded", auth.ClientIDFrom(ctx), req.Function, fmt.Sprintf("applied: %v, restart required: %v", result.Applied, result.RestartRequired))
+
+	resp := response.New(http.StatusOK)
+	resp.PutObject("applied", result.Applied)
+	resp.PutObject("restartRequired", result.RestartRequired)
+	return resp, false, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+type RemoveUserHandler struct {
+}
+
+func (h *RemoveUserHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("RemoveUserHandler")
+
+	username, err := req.GetString("username")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'username' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	err = current().userStore.Delete(username)
+	if errors.Is(err, users.ErrNotFound) {
+		resp := response.New(http.StatusNotFound)
+		resp.PutMessage(fmt.Sprintf("user '%s' not found", username))
+		return resp, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	audit.Record("user-removed", auth.ClientIDFrom(ctx), req.Function, username)
+	cancelEnable(username)
+
+	err = brokerClients.Delete(ctx, username)
+	if err != nil {
+		resp := response.New(http.StatusBadGateway)
+		resp.PutMessage(fmt.Sprintf("user '%s' was removed, but their broker client was not: %s", username, err))
+		return resp, false, nil
+	}
+
+	resp := response.New(http.StatusOK)
+	return resp, false, nil
+}
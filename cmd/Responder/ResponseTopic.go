@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// checkResponseTopic makes sure a request can only have its reply sent to the client which made it, otherwise
+// anyone could have the Responder publish diary data on any topic, including another client's response topic. The
+// ResponseTopic must be laid out exactly as a response topic, for the client named in the request. The broker's ACL
+// keeps the username level to the user who is logged on, and when the request has a token the username level must
+// be its subject, so the reply goes to the user the token was issued to
+func checkResponseTopic(packet *paho.Publish, c *call) error {
+
+	responseTopic := packet.Properties.ResponseTopic
+	clientID := c.clientID
+
+	if clientID == "" {
+		return fmt.Errorf("request has no clientId")
+	}
+	if strings.ContainsAny(clientID, "/+#") {
+		return fmt.Errorf("unexpected clientId: %s", clientID)
+	}
+
+	topicUsername, topicClientID, ok := topics.ParseResponse(responseTopic)
+	if !ok {
+		return fmt.Errorf("responseTopic is not a response topic: %s", responseTopic)
+	}
+	if topicClientID != clientID {
+		return fmt.Errorf("responseTopic '%s' is not a response topic of client '%s'", responseTopic, clientID)
+	}
+	if c.claims != nil && topicUsername != c.claims.Subject {
+		return fmt.Errorf("responseTopic '%s' is not a response topic of user '%s'", responseTopic, c.claims.Subject)
+	}
+
+	return nil
+}
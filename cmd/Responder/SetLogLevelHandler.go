@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+)
+
+type SetLogLevelHandler struct {
+}
+
+// Handle changes the level of a component, or the default level if the component is empty, until the next
+// reload or restart
+func (h *SetLogLevelHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("SetLogLevelHandler")
+
+	component, err := req.GetString("component")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'component' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	level, err := req.GetString("level")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'level' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	err = loggerlevel.SetLevel(component, level)
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(err.Error())
+		return resp, false, nil
+	}
+
+	audit.Record("log-level", auth.ClientIDFrom(ctx), req.Function, fmt.Sprintf("component: '%s', level: %s", component, level))
+
+	resp := response.New(http.StatusOK)
+	resp.PutObject("levels", loggerlevel.Levels())
+	return resp, false, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/diaries"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+)
+
+type ShareDiaryHandler struct {
+}
+
+func (h *ShareDiaryHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("ShareDiaryHandler")
+
+	diary, err := req.GetInteger("diary")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'diary' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	username, err := req.GetString("username")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'username' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	access, err := req.GetString("access")
+	if err != nil {
+		resp := response.New(http.StatusBadRequest)
+		resp.PutMessage(fmt.Sprintf("could not find 'access' in arguments: %s", err))
+		return resp, false, nil
+	}
+
+	err = diaryStore.Share(diary, username, access)
+	if errors.Is(err, diaries.ErrNotFound) {
+		resp := response.New(http.StatusNotFound)
+		resp.PutMessage(err.Error())
+		return resp, false, nil
+	}
+	if err != nil {
+		return response.BadRequest(err.Error()), false, nil
+	}
+
+	audit.Record("diary-shared", auth.ClientIDFrom(ctx), req.Function, fmt.Sprintf("diary: %d, username: %s, access: %s", diary, username, access))
+
+	resp := response.New(http.StatusOK)
+	return resp, false, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rsmaxwell/diaries/internal/connection"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+	"github.com/rsmaxwell/diaries/internal/stats"
+)
+
+type StatsHandler struct {
+}
+
+func (h *StatsHandler) Handle(ctx context.Context, req request.Request) (*response.Response, bool, error) {
+	handlerLog.Debug("StatsHandler")
+
+	resp := response.New(http.StatusOK)
+	resp.PutObject("counters", stats.Snapshot())
+	resp.PutObject("rateLimits", map[string]interface{}{
+		"clients":   current().clientLimiter.State(),
+		"functions": current().functionLimiter.State(),
+	})
+	resp.PutObject("queues", requestScheduler.State())
+	resp.PutObject("database", data.Stats())
+	resp.PutString("broker", connection.Current())
+	return resp, false, nil
+}
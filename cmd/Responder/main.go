@@ -9,31 +9,42 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log/slog"
-	"net/url"
+	"math"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/audit"
+	"github.com/rsmaxwell/diaries/internal/auth"
 	"github.com/rsmaxwell/diaries/internal/config"
-	"github.com/rsmaxwell/diaries/internal/database"
+	"github.com/rsmaxwell/diaries/internal/connection"
+	"github.com/rsmaxwell/diaries/internal/deadletter"
+	"github.com/rsmaxwell/diaries/internal/diaries"
+	"github.com/rsmaxwell/diaries/internal/dynsec"
+	"github.com/rsmaxwell/diaries/internal/encryption"
 	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/mosquitto"
+	"github.com/rsmaxwell/diaries/internal/ratelimit"
 	"github.com/rsmaxwell/diaries/internal/request"
 	"github.com/rsmaxwell/diaries/internal/response"
+	"github.com/rsmaxwell/diaries/internal/scheduler"
+	"github.com/rsmaxwell/diaries/internal/signing"
+	"github.com/rsmaxwell/diaries/internal/stats"
+	"github.com/rsmaxwell/diaries/internal/storage"
 
 	_ "github.com/lib/pq"
 )
 
-const (
-	qos          = 0
-	requestTopic = "request"
-)
-
 type Handler interface {
-	Handle(request.Request) (*response.Response, bool, error)
+	Handle(context.Context, request.Request) (*response.Response, bool, error)
 }
 
 var (
@@ -41,9 +52,47 @@ var (
 		"buildinfo":  new(BuildInfoHandler),
 		"calculator": new(CalculatorHandler),
 
-		"getPages": new(GetPagesHandler),
-		"quit":     new(QuitHandler),
+		"getDiaries": new(GetDiariesHandler),
+		"getPages":   new(GetPagesHandler),
+		"addDiary":   new(AddDiaryHandler),
+		"addPage":    new(AddPageHandler),
+		"shareDiary": new(ShareDiaryHandler),
+		"quit":       new(QuitHandler),
+		"stats":      new(StatsHandler),
+
+		"login":          new(LoginHandler),
+		"logout":         new(LogoutHandler),
+		"refreshToken":   new(RefreshTokenHandler),
+		"changePassword": new(ChangePasswordHandler),
+
+		"reload":      new(ReloadHandler),
+		"setLogLevel": new(SetLogLevelHandler),
+
+		"createUser": new(CreateUserHandler),
+		"removeUser": new(RemoveUserHandler),
+		"lockUser":   new(LockUserHandler),
+	}
+
+	// Functions which can be called without a token, which is how a token is obtained in the first place
+	publicFunctions = map[string]bool{
+		"login":        true,
+		"refreshToken": true,
 	}
+
+	qos             byte
+	topics          *config.TopicsConfig
+	deadLetterTopic string
+
+	requestScheduler *scheduler.Scheduler
+
+	data       *storage.Storage // Postgres, or memory for demos and tests
+	diaryStore *diaries.Store
+
+	handlerLog = loggerlevel.Logger(loggerlevel.Handlers)
+	mqttLog    = loggerlevel.Logger(loggerlevel.Mqtt)
+
+	brokerClients *dynsec.Client // Provisions the users' broker clients, when dynamic security is enabled
+	brokerTopics  *mosquitto.Topics
 )
 
 func main() {
@@ -56,121 +105,209 @@ func main() {
 
 	slog.Info("diaries Responder")
 
+	flag.Parse()
+
 	config, err := config.Read()
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
-	db, err := database.Connect(&config.Db)
+	err = loggerlevel.Configure(&config.Logging)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// SIGHUP reloads the configuration, as does the reload request. It is caught from the start, so one which
+	// arrives while the database is being waited for does not end the Responder, and is acted on once it is running
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	qos = config.Mqtt.GetQoS()
+	err = audit.Open(config.Audit.File)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	brokerClients, err = dynsec.New(&config.DynamicSecurity)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	brokerTopics = mosquitto.NewTopics(config)
+
+	topics = &config.Topics
+	deadLetterTopic = config.Topics.GetTopic(config.DeadLetter.GetTopic())
+	deadLetterLimiter = ratelimit.New(config.DeadLetter.GetRateLimit(), nil, 0)
+	expiry, err := config.DeadLetter.GetExpiry()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	deadLetterExpiry = uint32(min(expiry.Seconds(), math.MaxUint32))
+
+	data, err = storage.Open(context.Background(), &config.Db)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	defer data.Close()
+
+	s, err := newSettings(config, nil)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
-	defer db.Close()
+	live.Store(s)
+	started = config
 
-	serverUrl, err := url.Parse(config.Mqtt.GetServer())
+	// The schema is changed by the Migrate command, never by the Responder
+	err = data.Check(context.Background())
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
+	diaryStore = diaries.NewStore(data.Diaries)
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mqttConfig := autopaho.ClientConfig{
-		ServerUrls:        []*url.URL{serverUrl},
-		KeepAlive:         30,
-		ConnectRetryDelay: 2 * time.Second,
-		ConnectTimeout:    5 * time.Second,
-		OnConnectError:    func(err error) { slog.Info(fmt.Sprintf("error whilst attempting connection: %s\n", err)) },
-		ClientConfig: paho.ClientConfig{
-			OnClientError: func(err error) { slog.Info(fmt.Sprintf("requested disconnect: %s\n", err)) },
-
-			OnServerDisconnect: func(d *paho.Disconnect) {
-				if d.Properties != nil {
-					slog.Info(fmt.Sprintf("requested disconnect: %s\n", d.Properties.ReasonString))
-				} else {
-					slog.Info(fmt.Sprintf("requested disconnect; reason code: %d\n", d.ReasonCode))
-				}
-			},
-		},
-		ConnectUsername: config.Mqtt.Username,
-		ConnectPassword: []byte(config.Mqtt.Password),
+	requestScheduler = scheduler.New(s.aging, s.queueSize)
+	requestScheduler.Run(ctx, config.Scheduler.GetWorkers())
+	go reloadOnSignal(hangups)
+	var quitOnce sync.Once
+
+	mqttConfig, err := connection.NewConfig(ctx, &config.Mqtt, "responder")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// The status topic says whether the Responder is running. The broker publishes the will if the connection is lost
+	statusTopic := topics.GetStatus(mqttConfig.ClientID)
+	mqttConfig.WillMessage = &paho.WillMessage{
+		Retain:  true,
+		QoS:     qos,
+		Topic:   statusTopic,
+		Payload: []byte("offline"),
 	}
 
-	mqttConfig.ClientConfig.ClientID = "listener"
 	// Subscribing in OnConnectionUp is the recommended approach because this ensures the subscription is reestablished
-	// following reconnection (the subscription should survive `cliCfg.SessionExpiryInterval` after disconnection,
-	// but in this case that is 0, and it's safer if we don't assume the session survived anyway).
+	// following reconnection. With a SessionExpiryInterval the subscription also survives a restart, and the broker
+	// queues requests (at QoS 1) until the Responder is back. Those requests are delivered as soon as the connection
+	// is made, and go through the scheduler like any other, so any that have expired in the meantime are discarded.
 	mqttConfig.OnConnectionUp = func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5*time.Second))
 		defer cancel()
+		subscriptions := []paho.SubscribeOptions{
+			{Topic: topics.GetRequest(), QoS: qos},
+		}
+		if brokerClients != nil {
+			subscriptions = append(subscriptions, paho.SubscribeOptions{Topic: brokerClients.ResponseTopic(), QoS: 1})
+		}
 		if _, err := cm.Subscribe(ctx, &paho.Subscribe{
-			Subscriptions: []paho.SubscribeOptions{
-				{Topic: requestTopic, QoS: qos},
-			},
+			Subscriptions: subscriptions,
 		}); err != nil {
-			slog.Info(fmt.Sprintf("listener failed to subscribe (%s). This is likely to mean no messages will be received.", err))
+			mqttLog.Error("failed to subscribe, so no requests will be received", "error", err)
 			return
 		}
+		if _, err := cm.Publish(ctx, &paho.Publish{
+			QoS:     qos,
+			Retain:  true,
+			Topic:   statusTopic,
+			Payload: []byte("online"),
+		}); err != nil {
+			mqttLog.Warn("could not publish status", "topic", statusTopic, "error", err)
+		}
+		if brokerClients != nil {
+			brokerClients.SetPublisher(cm)
+			go reconcileBrokerClients(context.Background())
+		}
 	}
 	mqttConfig.OnPublishReceived = []func(paho.PublishReceived) (bool, error){
 		func(received paho.PublishReceived) (bool, error) {
 
-			slog.Info(fmt.Sprintf("Received request: %s", string(received.Packet.Payload)))
+			if brokerClients != nil && received.Packet.Topic == brokerClients.ResponseTopic() {
+				brokerClients.Deliver(received.Packet)
+				return true, nil
+			}
+
+			mqttLog.Debug(fmt.Sprintf("Received request on %s: %s", received.Packet.Topic, loggerlevel.Payload(received.Packet.Payload)))
+			stats.Increment("requests")
 
 			if received.Packet.Properties == nil {
-				slog.Info("discarding request with no properties")
+				deadLetter(ctx, received, nil, deadletter.NoProperties, "discarding request with no properties")
 				return true, nil
 			}
 
 			if received.Packet.Properties.CorrelationData == nil {
-				slog.Info("discarding request with no CorrelationData")
+				deadLetter(ctx, received, nil, deadletter.NoCorrelationData, "discarding request with no CorrelationData")
 				return true, nil
 			}
 
 			if received.Packet.Properties.ResponseTopic == "" {
-				slog.Info("discarding request with empty responseTopic")
+				deadLetter(ctx, received, nil, deadletter.NoResponseTopic, "discarding request with empty responseTopic")
 				return true, nil
 			}
 
-			resp, quit, err := getResult(received)
+			// Encrypted requests are answered with an encrypted reply, using the same key
+			payload, keyID, err := current().keyring.Open(received.Packet.Properties, received.Packet.Payload, encryption.RequestData(received.Packet.Topic, received.Packet.Properties.ResponseTopic))
 			if err != nil {
-				slog.Info(err.Error())
+				audit.Record("decrypt-failed", received.Packet.Properties.User.Get("clientId"), "", err.Error())
+				deadLetter(ctx, received, nil, deadletter.DecryptFailed, fmt.Sprintf("discarding request: %s", err))
 				return true, nil
 			}
 
-			body, err := json.Marshal(resp)
-			if err != nil {
-				slog.Info(err.Error())
+			c := newCall(received.Packet, payload, keyID != "")
+
+			// A token which does not verify is refused by the worker, so until then its caller counts as anonymous
+			c.claims, c.authErr = identify(c)
+
+			if err := checkResponseTopic(received.Packet, c); err != nil {
+				audit.Record("invalid-response-topic", c.clientID, "", err.Error())
+				deadLetter(ctx, received, payload, deadletter.InvalidResponseTopic, fmt.Sprintf("discarding request: %s", err))
 				return true, nil
 			}
 
-			slog.Info(fmt.Sprintf("Sending reply: %s", string(body)))
-
-			_, err = received.Client.Publish(ctx, &paho.Publish{
-				Properties: &paho.PublishProperties{
-					CorrelationData: received.Packet.Properties.CorrelationData,
-				},
-				Topic:   received.Packet.Properties.ResponseTopic,
-				Payload: body,
-			})
-			if err != nil {
-				slog.Info(err.Error())
+			deadline, expires := requestDeadline(received.Packet)
+			if expires && !time.Now().Before(deadline) {
+				expired(received)
 				return true, nil
 			}
 
-			if quit {
-				wg.Done()
+			// Requests which are refused are answered at once, without taking a place in the queue
+			resp := admit(c)
+			if resp == nil {
+				priority := requestPriority(received.Packet, &c.req)
+				mqttLog.Debug("scheduling request", "priority", priority)
+
+				queued := requestScheduler.Submit(priority, func() {
+					if expires && !time.Now().Before(deadline) {
+						expired(received)
+						return
+					}
+					if reply(ctx, received, payload, keyID, deadline, expires, c) {
+						quitOnce.Do(wg.Done)
+					}
+				})
+				if !queued {
+					stats.Increment("rejected.queueFull")
+					resp = response.ServiceUnavailable(fmt.Sprintf("the %s queue is full", priority), time.Second)
+				}
+			}
+			if resp != nil {
+				send(ctx, received, payload, keyID, deadline, expires, resp)
 			}
 			return true, nil
 		}}
 
-	_, err = autopaho.NewConnection(ctx, mqttConfig)
+	_, err = autopaho.NewConnection(ctx, *mqttConfig)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
@@ -181,32 +318,214 @@ func main() {
 	slog.Info("Quitting")
 }
 
-func getResult(received paho.PublishReceived) (*response.Response, bool, error) {
+// reply handles a request and publishes the response, returning true if the Responder was asked to quit
+func reply(ctx context.Context, received paho.PublishReceived, payload []byte, keyID string, deadline time.Time, expires bool, c *call) bool {
 
-	var resp *response.Response
-	var req request.Request
-	if err := json.NewDecoder(bytes.NewReader(received.Packet.Payload)).Decode(&req); err != nil {
-		resp = response.BadRequest(fmt.Sprintf("request could not be decoded: %v", err))
-		return resp, false, nil
+	resp, quit, err := getResult(ctx, received, payload, c)
+	if err != nil {
+		deadLetter(ctx, received, payload, deadletter.HandlerFailed, err.Error())
+		return false
+	}
+
+	return send(ctx, received, payload, keyID, deadline, expires, resp) && quit
+}
+
+// send publishes the response to a request, returning false if it could not. The reply is encrypted when keyID is set
+func send(ctx context.Context, received paho.PublishReceived, payload []byte, keyID string, deadline time.Time, expires bool, resp *response.Response) bool {
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		deadLetter(ctx, received, payload, deadletter.MarshalFailed, err.Error())
+		return false
+	}
+
+	mqttLog.Debug(fmt.Sprintf("Sending reply: %s", loggerlevel.Payload(body)))
+
+	properties := &paho.PublishProperties{
+		CorrelationData: received.Packet.Properties.CorrelationData,
+	}
+
+	// The reply is of no use once the requester has given up waiting. A MessageExpiry of 0 would not expire at all,
+	// so it is at least a second
+	if expires {
+		left := time.Until(deadline)
+		if left <= 0 {
+			expired(received)
+			return false
+		}
+		remaining := uint32(max(math.Ceil(left.Seconds()), 1))
+		properties.MessageExpiry = &remaining
+	}
+
+	s := current()
+	err = s.signer.Sign(properties, signing.Message{CorrelationData: properties.CorrelationData, ResponseTopic: received.Packet.Properties.ResponseTopic}, body)
+	if err != nil {
+		deadLetter(ctx, received, payload, deadletter.MarshalFailed, err.Error())
+		return false
+	}
+
+	if keyID != "" {
+		body, err = s.keyring.Seal(properties, keyID, body, encryption.ReplyData(received.Packet.Properties.ResponseTopic, properties.CorrelationData))
+		if err != nil {
+			deadLetter(ctx, received, payload, deadletter.EncryptFailed, err.Error())
+			return false
+		}
+	}
+
+	_, err = received.Client.Publish(ctx, &paho.Publish{
+		QoS:        qos,
+		Properties: properties,
+		Topic:      received.Packet.Properties.ResponseTopic,
+		Payload:    body,
+	})
+	if err != nil {
+		deadLetter(ctx, received, payload, deadletter.PublishFailed, err.Error())
+		return false
+	}
+	stats.Increment("replies")
+
+	return true
+}
+
+// requestDeadline works out when the request expires. The broker sets MessageExpiry to the time the request has left,
+// so it is measured from when the request was received
+func requestDeadline(packet *paho.Publish) (time.Time, bool) {
+	if packet.Properties.MessageExpiry == nil {
+		return time.Time{}, false
+	}
+	return time.Now().Add(time.Duration(*packet.Properties.MessageExpiry) * time.Second), true
+}
+
+// expired drops a request whose requester has already given up waiting for the reply
+func expired(received paho.PublishReceived) {
+	mqttLog.Info("discarding expired request", "topic", received.Packet.Topic, "payload", loggerlevel.Payload(received.Packet.Payload))
+	stats.Increment("expired")
+}
+
+// requestPriority takes the priority from the 'priority' user property, then the request envelope, and
+// then the configured default for the function
+func requestPriority(packet *paho.Publish, req *request.Request) scheduler.Priority {
+
+	for _, value := range []string{packet.Properties.User.Get("priority"), req.Priority, current().functionPriorities[req.Function]} {
+		if value == "" {
+			continue
+		}
+		priority, err := scheduler.ParsePriority(value)
+		if err != nil {
+			mqttLog.Warn("ignoring priority", "error", err)
+			continue
+		}
+		return priority
+	}
+
+	return scheduler.Normal
+}
+
+// call is a request on its way from the broker to a worker
+type call struct {
+	req       request.Request
+	decodeErr error
+	clientID  string // The client the request is from
+	token     string
+	handler   Handler
+	claims    *auth.Claims
+	authErr   error // Why the request's token was refused, if it was
+}
+
+// newCall decodes a request. The client id and bearer token of an encrypted request are taken from inside it, so they
+// are kept secret and cannot be changed on the way. Otherwise they are taken from the 'clientId' and 'authorization'
+// user properties, or else from the request itself. MQTT does not pass the publisher's client id on to subscribers,
+// so checkResponseTopic binds the client id, and the subject of the token, to the response topic
+func newCall(packet *paho.Publish, payload []byte, encrypted bool) *call {
+
+	c := new(call)
+	c.decodeErr = json.NewDecoder(bytes.NewReader(payload)).Decode(&c.req)
+
+	c.clientID, c.token = c.req.ClientID, c.req.Token
+	if !encrypted {
+		if clientID := packet.Properties.User.Get("clientId"); clientID != "" {
+			c.clientID = clientID
+		}
+		if token := strings.TrimSpace(strings.TrimPrefix(packet.Properties.User.Get("authorization"), "Bearer ")); token != "" {
+			c.token = token
+		}
+	}
+	return c
+}
+
+// admit checks a request and applies the rate limits as soon as it arrives, so a request which is refused never
+// takes a place in the queue. It returns the response to send straight away when the request is refused
+func admit(c *call) *response.Response {
+
+	if c.decodeErr != nil {
+		return response.BadRequest(fmt.Sprintf("request could not be decoded: %v", c.decodeErr))
+	}
+
+	if c.req.Args == nil {
+		return response.BadRequest("missing request")
+	}
+
+	if len(c.req.Function) == 0 {
+		return response.BadRequest("empty function")
+	}
+
+	c.handler = requestHandlers[c.req.Function]
+	if c.handler == nil {
+		return response.BadRequest(fmt.Sprintf("unexpected function: %s", c.req.Function))
+	}
+
+	s := current()
+
+	if ok, retryAfter := s.clientLimiter.Allow(bucket(c.claims)); !ok {
+		stats.Increment("rateLimited.client")
+		return response.TooManyRequests("too many requests from this client", retryAfter)
+	}
+
+	if ok, retryAfter := s.functionLimiter.Allow(c.req.Function); !ok {
+		stats.Increment("rateLimited.function")
+		return response.TooManyRequests(fmt.Sprintf("too many requests for function: %s", c.req.Function), retryAfter)
 	}
 
-	if req.Args == nil {
-		resp = response.BadRequest("missing request")
+	return nil
+}
+
+func getResult(ctx context.Context, received paho.PublishReceived, payload []byte, c *call) (*response.Response, bool, error) {
+
+	var resp *response.Response
+	req := c.req
+	s := current()
+
+	signedBy, err := s.registry.Verify(received.Packet.Properties, signing.Message{
+		Function:        req.Function,
+		CorrelationData: received.Packet.Properties.CorrelationData,
+		ResponseTopic:   received.Packet.Properties.ResponseTopic,
+	}, payload)
+	if err != nil {
+		audit.Record("signature-failed", c.clientID, req.Function, err.Error())
+		resp = response.Unauthorized(err.Error())
 		return resp, false, nil
 	}
+	if signedBy != "" {
+		handlerLog.Debug("request signed", "by", signedBy)
+	}
 
-	if len(req.Function) == 0 {
-		resp = response.BadRequest("empty function")
+	ctx = auth.WithClientID(ctx, c.clientID)
+
+	authErr := c.authErr
+	if authErr == nil {
+		ctx, authErr = authenticate(ctx, &req, c.claims)
+	}
+	if err := authErr; err != nil {
+		audit.Record("unauthenticated", c.clientID, req.Function, err.Error())
+		resp = response.Unauthorized(err.Error())
 		return resp, false, nil
 	}
 
-	handler := requestHandlers[req.Function]
-	if handler == nil {
-		resp = response.BadRequest(fmt.Sprintf("unexpected function: %s", req.Function))
+	if resp = authorize(ctx, req.Function); resp != nil {
 		return resp, false, nil
 	}
 
-	resp, quit, err := handler.Handle(req)
+	resp, quit, err := c.handler.Handle(ctx, req)
 	if err != nil {
 		resp = response.BadRequest(fmt.Sprintf("handler '%s' failed: %s", req.Function, err))
 		return resp, false, nil
@@ -2,10 +2,16 @@ module github.com/rsmaxwell/diaries
 
 go 1.22.0
 
-require github.com/eclipse/paho.golang v0.21.0
+require (
+	github.com/eclipse/paho.golang v0.21.0
+	golang.org/x/term v0.18.0
+)
+
+require golang.org/x/sys v0.18.0 // indirect
 
 require (
-	github.com/gorilla/websocket v1.5.1 // indirect
+	github.com/gorilla/websocket v1.5.1
 	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.21.0
 	golang.org/x/net v0.21.0 // indirect
 )
@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry records a security relevant event, such as a request which was refused
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Client   string    `json:"client,omitempty"`
+	Function string    `json:"function,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+var (
+	mutex sync.Mutex
+	file  *os.File
+)
+
+// Open appends the audit trail to the file as JSON lines. Without a file, entries are only logged
+func Open(filename string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if file != nil {
+		file.Close()
+		file = nil
+	}
+
+	if filename == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open audit file: %w", err)
+	}
+	file = f
+	return nil
+}
+
+func Record(event string, client string, function string, detail string) {
+
+	entry := Entry{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		Client:   client,
+		Function: function,
+		Detail:   detail,
+	}
+
+	slog.Warn(fmt.Sprintf("audit: %s: client: %s, function: %s: %s", event, client, function, detail))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if file == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error(fmt.Sprintf("could not marshal audit entry: %s", err))
+		return
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		slog.Error(fmt.Sprintf("could not write audit entry: %s", err))
+	}
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+type Key struct {
+	ID         string
+	Algorithm  string
+	secret     []byte
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+// KeySet holds the keys which tokens may be signed with. Listing an old key alongside a new one lets
+// tokens signed with either be accepted while keys are rotated
+type KeySet struct {
+	keys     []*Key
+	issuer   string
+	audience string
+	leeway   time.Duration
+}
+
+func NewKeySet(c *config.AuthConfig) (*KeySet, error) {
+
+	k := new(KeySet)
+	k.issuer = c.Issuer
+	k.audience = c.Audience
+
+	leeway, err := c.GetLeeway()
+	if err != nil {
+		return nil, err
+	}
+	k.leeway = leeway
+
+	for _, kc := range c.Keys {
+		key, err := newKey(&kc)
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, key)
+	}
+
+	return k, nil
+}
+
+func newKey(c *config.TokenKey) (*Key, error) {
+
+	key := &Key{ID: c.ID, Algorithm: c.Algorithm}
+
+	switch c.Algorithm {
+	case HS256:
+		secret, err := base64.StdEncoding.DecodeString(c.Secret.Value())
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': could not decode secret: %w", c.ID, err)
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("key '%s': the secret must be at least 32 bytes", c.ID)
+		}
+		key.secret = secret
+
+	case EdDSA:
+		if c.PrivateKey.IsSet() {
+			seed, err := base64.StdEncoding.DecodeString(c.PrivateKey.Value())
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, fmt.Errorf("key '%s': the private key must be a base64 %d byte seed", c.ID, ed25519.SeedSize)
+			}
+			key.privateKey = ed25519.NewKeyFromSeed(seed)
+			key.publicKey = key.privateKey.Public().(ed25519.PublicKey)
+		}
+		if c.PublicKey != "" {
+			publicKey, err := base64.StdEncoding.DecodeString(c.PublicKey)
+			if err != nil || len(publicKey) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key '%s': the public key must be %d base64 bytes", c.ID, ed25519.PublicKeySize)
+			}
+			if key.publicKey != nil && !key.publicKey.Equal(ed25519.PublicKey(publicKey)) {
+				return nil, fmt.Errorf("key '%s': the public key does not match the private key", c.ID)
+			}
+			key.publicKey = publicKey
+		}
+		if key.publicKey == nil {
+			return nil, fmt.Errorf("key '%s': an EdDSA key needs a public or private key", c.ID)
+		}
+
+	default:
+		return nil, fmt.Errorf("key '%s': unexpected algorithm: %s", c.ID, c.Algorithm)
+	}
+
+	return key, nil
+}
+
+// SigningKey returns the key new tokens are signed with, which is the first in the list
+func (k *KeySet) SigningKey() (*Key, error) {
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("no token keys are configured")
+	}
+	return k.keys[0], nil
+}
+
+// Issue signs a token for the subject, valid for the given time and only for the given client
+func (k *KeySet) Issue(subject string, role string, clientID string, ttl time.Duration) (string, *Claims, error) {
+	return k.IssueForSession(subject, role, clientID, "", ttl)
+}
+
+// IssueForSession signs a token which is only accepted while the login session is active
+func (k *KeySet) IssueForSession(subject string, role string, clientID string, sessionID string, ttl time.Duration) (string, *Claims, error) {
+
+	if clientID == "" {
+		return "", nil, fmt.Errorf("a token must be bound to a client id")
+	}
+
+	key, err := k.SigningKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	claims := &Claims{
+		Issuer:    k.issuer,
+		Subject:   subject,
+		Audience:  k.audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ClientID:  clientID,
+		SessionID: sessionID,
+		Role:      role,
+	}
+
+	token, err := Sign(claims, key)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"context"
+)
+
+// Principal is the verified caller of a request
+type Principal struct {
+	Subject  string
+	Role     string
+	ClientID string
+	Claims   *Claims
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the caller, or nil when the request was not authenticated
+func PrincipalFrom(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+type clientIDKey struct{}
+
+// WithClientID records the MQTT client which sent the request, whether or not it was authenticated
+func WithClientID(ctx context.Context, clientID string) context.Context {
+	return context.WithValue(ctx, clientIDKey{}, clientID)
+}
+
+func ClientIDFrom(ctx context.Context) string {
+	clientID, _ := ctx.Value(clientIDKey{}).(string)
+	return clientID
+}
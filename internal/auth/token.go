@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256" // HMAC with SHA-256
+	EdDSA = "EdDSA" // Ed25519
+)
+
+// Claims are carried in a token, which has the same compact form as a JWT
+type Claims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	ID        string `json:"jti,omitempty"`
+	ClientID  string `json:"cid,omitempty"` // The client the token was issued to, which is the only one that may use it
+	SessionID string `json:"sid,omitempty"` // The login session the token belongs to, which may be revoked
+	Role      string `json:"role,omitempty"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign issues a token for the claims, signed with the key
+func Sign(claims *Claims, key *Key) (string, error) {
+
+	h, err := json.Marshal(header{Algorithm: key.Algorithm, Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+
+	var signature []byte
+	switch key.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case EdDSA:
+		if key.privateKey == nil {
+			return "", fmt.Errorf("key '%s' has no private key, so cannot sign", key.ID)
+		}
+		signature = ed25519.Sign(key.privateKey, []byte(signingInput))
+	default:
+		return "", fmt.Errorf("unexpected algorithm: %s", key.Algorithm)
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the token's signature against the key set, then its issuer, audience and lifetime
+func (k *KeySet) Verify(token string) (*Claims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerBytes, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	var h header
+	if err := json.Unmarshal(headerBytes, &h); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, key := range k.keys {
+		if h.KeyID != "" && h.KeyID != key.ID {
+			continue
+		}
+
+		// The algorithm is fixed by the key, never by the token, so a token cannot choose a weaker check
+		if h.Algorithm != key.Algorithm {
+			continue
+		}
+
+		switch key.Algorithm {
+		case HS256:
+			mac := hmac.New(sha256.New, key.secret)
+			mac.Write(signingInput)
+			verified = hmac.Equal(signature, mac.Sum(nil))
+		case EdDSA:
+			verified = ed25519.Verify(key.publicKey, signingInput, signature)
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	claimsBytes, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	var claims Claims
+	if err := json.Unmarshal(claimsBytes, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	if k.issuer != "" && claims.Issuer != k.issuer {
+		return nil, fmt.Errorf("unexpected token issuer: %s", claims.Issuer)
+	}
+
+	if k.audience != "" && claims.Audience != k.audience {
+		return nil, fmt.Errorf("unexpected token audience: %s", claims.Audience)
+	}
+
+	now := time.Now()
+
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(k.leeway)) {
+		return nil, fmt.Errorf("token has expired")
+	}
+	if claims.NotBefore != 0 && now.Add(k.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("token is not valid yet")
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+
+	return &claims, nil
+}
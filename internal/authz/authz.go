@@ -0,0 +1,80 @@
+package authz
+
+import (
+	"sort"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+const (
+	Admin       = "admin"
+	Editor      = "editor"
+	Transcriber = "transcriber"
+	Reader      = "reader"
+	Anonymous   = "anonymous" // A caller without a token, when authentication is not required
+
+	All = "*"
+)
+
+// defaultRoles says which functions each role may call. Editors add diaries and pages, transcribers add pages to
+// the diaries they are given and readers only read. Access to a particular diary is checked separately, against
+// the diary's access list
+var defaultRoles = map[string][]string{
+	Admin:       {All},
+	Editor:      {"buildinfo", "calculator", "getDiaries", "getPages", "addDiary", "addPage", "logout", "changePassword"},
+	Transcriber: {"buildinfo", "calculator", "getDiaries", "getPages", "addPage", "logout", "changePassword"},
+	Reader:      {"buildinfo", "calculator", "getDiaries", "getPages", "logout", "changePassword"},
+	Anonymous:   {"buildinfo", "calculator"},
+}
+
+// Policy maps roles to the functions they may call
+type Policy struct {
+	roles map[string]map[string]bool
+}
+
+// NewPolicy uses the configured roles, falling back to the defaults for any role not configured
+func NewPolicy(c *config.AuthzConfig) *Policy {
+
+	p := new(Policy)
+	p.roles = make(map[string]map[string]bool)
+
+	for role, functions := range defaultRoles {
+		p.set(role, functions)
+	}
+	for role, functions := range c.Roles {
+		p.set(role, functions)
+	}
+
+	return p
+}
+
+func (p *Policy) set(role string, functions []string) {
+	allowed := make(map[string]bool)
+	for _, function := range functions {
+		allowed[function] = true
+	}
+	p.roles[role] = allowed
+}
+
+func (p *Policy) Allowed(role string, function string) bool {
+	allowed := p.roles[role]
+	return allowed[All] || allowed[function]
+}
+
+// Roles returns the roles users may have, in order
+func (p *Policy) Roles() []string {
+	roles := []string{}
+	for role := range p.roles {
+		if role != Anonymous {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Known reports whether the role has been defined
+func (p *Policy) Known(role string) bool {
+	_, ok := p.roles[role]
+	return ok
+}
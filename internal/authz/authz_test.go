@@ -0,0 +1,38 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+func TestDefaultRoles(t *testing.T) {
+
+	p := NewPolicy(&config.AuthzConfig{})
+
+	tests := []struct {
+		role     string
+		function string
+		want     bool
+	}{
+		{Admin, "quit", true},
+		{Editor, "addDiary", true},
+		{Editor, "addPage", true},
+		{Editor, "quit", false},
+		{Transcriber, "addDiary", false},
+		{Transcriber, "addPage", true},
+		{Transcriber, "getPages", true},
+		{Reader, "addDiary", false},
+		{Reader, "addPage", false},
+		{Reader, "getPages", true},
+		{Anonymous, "getDiaries", false},
+		{Anonymous, "buildinfo", true},
+		{"unknown", "buildinfo", false},
+	}
+
+	for _, tt := range tests {
+		if got := p.Allowed(tt.role, tt.function); got != tt.want {
+			t.Errorf("Allowed(%s, %s) = %v, want %v", tt.role, tt.function, got, tt.want)
+		}
+	}
+}
@@ -1,27 +1,68 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+type TLSConfig struct {
+	CAFile             string `json:"caFile"`             // PEM bundle of the CAs trusted to sign the broker's certificate
+	CertFile           string `json:"certFile"`           // PEM client certificate, when the broker requires one
+	KeyFile            string `json:"keyFile"`            // PEM private key of the client certificate
+	ServerName         string `json:"serverName"`         // Overrides the name checked against the broker's certificate
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"` // Do not verify the broker's certificate. Development only!
+}
+
+type WebSocketConfig struct {
+	Path    string            `json:"path"`    // Path of the websocket endpoint, e.g. /mqtt
+	Headers map[string]string `json:"headers"` // Extra headers sent with the websocket handshake
+	Proxy   string            `json:"proxy"`   // URL of an http proxy, defaults to the proxy environment variables
+}
+
+// BrokerConfig says how to reach and log on to one broker
+type BrokerConfig struct {
+	Scheme    string          `json:"scheme"` // mqtt, mqtts, ws or wss. Defaults to mqtt
+	Host      string          `json:"host"`
+	Port      int             `json:"port"`
+	Username  string          `json:"username"`
+	Password  Secret          `json:"password"`
+	TLS       TLSConfig       `json:"tls"`
+	WebSocket WebSocketConfig `json:"webSocket"`
+}
+
 type MqttConfig struct {
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	BrokerConfig                         // The broker, when there is only one
+	Brokers               []BrokerConfig `json:"brokers"`               // Brokers in order of preference, instead of the one above
+	Failback              string         `json:"failback"`              // How often to check if a preferred broker is back, defaults to 1m. 0 disables failback
+	ClientID              string         `json:"clientId"`              // Prefix of the client ids, defaults to the host name
+	SessionExpiryInterval uint32         `json:"sessionExpiryInterval"` // Seconds the broker keeps the session after a disconnect
+	CleanStart            bool           `json:"cleanStart"`            // Discard any existing session when first connecting
+	QoS                   *byte          `json:"qos"`                   // Defaults to 1, so requests are queued in the session
 }
 
 type Go struct {
-	Driver string `json:"driver"`
+	Driver string `json:"driver"` // postgres, or memory to keep everything in memory for demos and tests
 }
 
 type Jdbc struct {
 	Dbms string `json:"dbms"`
 }
 
+// DBPoolConfig limits the connections held open to the database. Zero leaves the driver's default
+type DBPoolConfig struct {
+	MaxOpenConns    int    `json:"maxOpenConns"`    // Connections open at once, in use or idle. Defaults to no limit
+	MaxIdleConns    int    `json:"maxIdleConns"`    // Idle connections kept for reuse, defaults to 2
+	ConnMaxLifetime string `json:"connMaxLifetime"` // How long a connection may be reused, e.g. 1h
+	ConnMaxIdleTime string `json:"connMaxIdleTime"` // How long a connection may sit idle, e.g. 5m
+}
+
 type DBConfig struct {
 	Go       Go     `json:"go"`
 	Jdbc     Jdbc   `json:"jdbc"`
@@ -29,31 +70,482 @@ type DBConfig struct {
 	Port     int    `json:"port"`
 	Database string `json:"database"`
 	Username string `json:"username"`
-	Password string `json:"password"`
+	Password Secret `json:"password"`
+
+	SSLMode         string       `json:"sslMode"`         // disable, require, verify-ca or verify-full. Defaults to require
+	SSLRootCert     string       `json:"sslRootCert"`     // PEM file of the CAs trusted to sign the server's certificate, for verify-ca and verify-full
+	ConnectTimeout  string       `json:"connectTimeout"`  // How long to wait for each connection to be made, defaults to 10s
+	ApplicationName string       `json:"applicationName"` // Shown in pg_stat_activity, defaults to diaries
+	StartupTimeout  string       `json:"startupTimeout"`  // How long to keep retrying the database when connecting, defaults to 30s. 0 tries once
+	Pool            DBPoolConfig `json:"pool"`
+
+	Seed string `json:"seed"` // JSON file of users and diaries loaded at startup by the memory driver
+}
+
+// TopicsConfig lays out the topics, so several environments can share a broker. The topics may include
+// {env}, the response and status topics include the {clientid}, and the response topic the broker {username}
+type TopicsConfig struct {
+	Prefix   string `json:"prefix"`   // Put in front of every topic, e.g. "diaries/{env}"
+	Env      string `json:"env"`      // Replaces {env}, e.g. dev, test or prod
+	Request  string `json:"request"`  // Defaults to "request"
+	Response string `json:"response"` // Defaults to "response/{username}/{clientid}"
+	Status   string `json:"status"`   // Defaults to "status/{clientid}"
+}
+
+type TokenKey struct {
+	ID         string `json:"id"`
+	Algorithm  string `json:"algorithm"`  // HS256 or EdDSA
+	Secret     Secret `json:"secret"`     // Base64 HMAC secret, for HS256
+	PublicKey  string `json:"publicKey"`  // Base64 Ed25519 public key, for EdDSA
+	PrivateKey Secret `json:"privateKey"` // Base64 Ed25519 seed, only needed to issue EdDSA tokens
+}
+
+type AuthConfig struct {
+	Required bool       `json:"required"` // Refuse requests without a token
+	Issuer   string     `json:"issuer"`
+	Audience string     `json:"audience"`
+	Leeway   string     `json:"leeway"` // Allowance for clock skew, defaults to 30s
+	Keys     []TokenKey `json:"keys"`   // The first key signs new tokens
+}
+
+type AuthzConfig struct {
+	Roles map[string][]string `json:"roles"` // The functions each role may call, "*" for all. Replaces the defaults for that role
+}
+
+type UsersConfig struct {
+	MaxFailures        int    `json:"maxFailures"`        // Failed logins in a row before the account is locked, defaults to 5
+	LockoutDuration    string `json:"lockoutDuration"`    // How long the account stays locked, defaults to 15m
+	AccessTokenExpiry  string `json:"accessTokenExpiry"`  // Lifetime of the token sent with requests, defaults to 15m
+	RefreshTokenExpiry string `json:"refreshTokenExpiry"` // Lifetime of a session without a refresh, defaults to 24h
+}
+
+type EncryptionKey struct {
+	ID   string `json:"id"`
+	Key  Secret `json:"key"`  // Base64 256 bit AES key
+	File string `json:"file"` // File containing the base64 key, instead of giving it here
+}
+
+// EncryptionConfig lists the keys payloads may be encrypted with. The first key encrypts new requests
+type EncryptionConfig struct {
+	Required bool            `json:"required"` // Refuse payloads which are not encrypted
+	Keys     []EncryptionKey `json:"keys"`
+}
+
+type SigningKey struct {
+	ID         string `json:"id"`
+	PrivateKey Secret `json:"privateKey"` // Base64 Ed25519 seed
+	File       string `json:"file"`       // File containing the base64 seed, instead of giving it here
+}
+
+type TrustedKey struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"publicKey"` // Base64 Ed25519 public key
+}
+
+// SigningConfig gives the key messages are signed with, and the keys whose signatures are accepted
+type SigningConfig struct {
+	Key         *SigningKey  `json:"key"`
+	Trusted     []TrustedKey `json:"trusted"`
+	Required    bool         `json:"required"`    // Refuse messages which are not signed
+	SignReplies bool         `json:"signReplies"` // The Responder signs its replies
+	Window      string       `json:"window"`      // How far a signature's timestamp may be from now
+}
+
+// DynamicSecurityConfig is for provisioning broker clients through Mosquitto's dynamic security plugin
+type DynamicSecurityConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Topic      string `json:"topic"`      // The control topic. A stand-in can listen on another topic
+	RolePrefix string `json:"rolePrefix"` // Prefixed to the diaries role to name the broker role
+	Timeout    string `json:"timeout"`    // How long to wait for the plugin to answer
+}
+
+// LoggingConfig says how the commands log. The levels are debug, info, warn or error
+type LoggingConfig struct {
+	Format       string            `json:"format"`       // text or json, defaults to text
+	Level        string            `json:"level"`        // Defaults to $LOGGER_LEVEL, or info
+	Levels       map[string]string `json:"levels"`       // Levels of particular components: mqtt, db or handlers
+	Payloads     string            `json:"payloads"`     // Whether message payloads are logged: off, truncated or full. Defaults to off
+	PayloadLimit int               `json:"payloadLimit"` // Bytes of a truncated payload which are logged, defaults to 256
+}
+
+type AuditConfig struct {
+	File string `json:"file"` // JSON lines file the audit trail is appended to
+}
+
+type DeadLetterConfig struct {
+	Topic     string     `json:"topic"`
+	Expiry    string     `json:"expiry"`    // How long the broker keeps a dead letter, defaults to 168h. 0 keeps it until it is purged
+	RateLimit *RateLimit `json:"rateLimit"` // Dead letters published beyond this are only logged, defaults to 1 a second with a burst of 10
+}
+
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // Requests per second
+	Burst int     `json:"burst"` // Requests which may be made at once
+}
+
+type RateLimitConfig struct {
+	Client    *RateLimit           `json:"client"`    // Limit for each client
+	Function  *RateLimit           `json:"function"`  // Limit for each function not listed in Functions
+	Functions map[string]RateLimit `json:"functions"` // Limits for particular functions
+
+	MaxClients int `json:"maxClients"` // Client buckets kept at once, defaults to 10000
+}
+
+type SchedulerConfig struct {
+	Workers    int               `json:"workers"`    // Number of requests handled at once
+	Aging      string            `json:"aging"`      // How long a request waits before being raised by one priority
+	QueueSize  int               `json:"queueSize"`  // Most requests waiting in each priority lane
+	Priorities map[string]string `json:"priorities"` // Default priority of each function (high, normal or low)
 }
 
 type Config struct {
-	Mqtt MqttConfig `json:"mqtt"`
-	Db   DBConfig   `json:"db"`
+	Mqtt       MqttConfig       `json:"mqtt"`
+	Topics     TopicsConfig     `json:"topics"`
+	Db         DBConfig         `json:"db"`
+	DeadLetter DeadLetterConfig `json:"deadLetter"`
+	Audit      AuditConfig      `json:"audit"`
+	Logging    LoggingConfig    `json:"logging"`
+	Auth       AuthConfig       `json:"auth"`
+	Authz      AuthzConfig      `json:"authz"`
+	Encryption EncryptionConfig `json:"encryption"`
+	Signing    SigningConfig    `json:"signing"`
+	Users      UsersConfig      `json:"users"`
+	RateLimits RateLimitConfig  `json:"rateLimits"`
+	Scheduler  SchedulerConfig  `json:"scheduler"`
+	Keystore   KeystoreConfig   `json:"keystore"`
+
+	DynamicSecurity DynamicSecurityConfig `json:"dynamicSecurity"`
+}
+
+func (c *BrokerConfig) GetScheme() string {
+	if c.Scheme == "" {
+		return "mqtt"
+	}
+	return strings.ToLower(c.Scheme)
+}
+
+// UsesWebSocket reports whether the scheme connects over a websocket
+func (c *BrokerConfig) UsesWebSocket() bool {
+	scheme := c.GetScheme()
+	return scheme == "ws" || scheme == "wss"
+}
+
+// UsesTLS reports whether the scheme connects over TLS
+func (c *BrokerConfig) UsesTLS() bool {
+	scheme := c.GetScheme()
+	return scheme == "mqtts" || scheme == "wss"
+}
+
+func (c *BrokerConfig) GetServer() string {
+	server := fmt.Sprintf("%s://%s:%d", c.GetScheme(), c.Host, c.Port)
+	if c.UsesWebSocket() && c.WebSocket.Path != "" {
+		server = server + "/" + strings.TrimPrefix(c.WebSocket.Path, "/")
+	}
+	return server
+}
+
+// GetBrokers returns the brokers in order of preference
+func (c *MqttConfig) GetBrokers() []BrokerConfig {
+	if len(c.Brokers) == 0 {
+		return []BrokerConfig{c.BrokerConfig}
+	}
+	return c.Brokers
+}
+
+func (c *MqttConfig) GetFailback() (time.Duration, error) {
+	if c.Failback == "" {
+		return time.Minute, nil
+	}
+	return time.ParseDuration(c.Failback)
+}
+
+// GetClientID returns a client id which stays the same from one run to the next, so the broker can resume the session
+func (c *MqttConfig) GetClientID(component string) (string, error) {
+	prefix := c.ClientID
+	if prefix == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		prefix = hostname
+	}
+	return fmt.Sprintf("%s-%s", prefix, component), nil
+}
+
+// GetUsername returns the broker user the component logs on as, which names its response topic. Every broker is
+// logged on to as the same user
+func (c *MqttConfig) GetUsername() string {
+	if username := c.GetBrokers()[0].Username; username != "" {
+		return username
+	}
+	return "anonymous"
+}
+
+// GetPassword returns the password of the broker user, from the first broker when there are several
+func (c *MqttConfig) GetPassword() string {
+	return c.GetBrokers()[0].Password.Value()
+}
+
+// GetRunClientID returns a client id for this run alone, made unique by a random suffix on the stable client id, for
+// the components which have no session to resume
+func (c *MqttConfig) GetRunClientID(component string) (string, error) {
+	clientID, err := c.GetClientID(component)
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return clientID + "-" + hex.EncodeToString(suffix), nil
+}
+
+func (c *MqttConfig) GetQoS() byte {
+	if c.QoS == nil {
+		return 1
+	}
+	return *c.QoS
+}
+
+// GetTopic puts the topic into the namespace
+func (c *TopicsConfig) GetTopic(topic string) string {
+	if c.Prefix != "" {
+		topic = strings.TrimSuffix(c.Prefix, "/") + "/" + topic
+	}
+	return strings.ReplaceAll(topic, "{env}", c.Env)
+}
+
+func (c *TopicsConfig) GetRequest() string {
+	if c.Request == "" {
+		return c.GetTopic("request")
+	}
+	return c.GetTopic(c.Request)
+}
+
+// GetResponse returns the response topic of a client, which is below the broker user it logs on as, so the broker's
+// ACL can keep each user to their own replies
+func (c *TopicsConfig) GetResponse(username string, clientID string) string {
+	return strings.NewReplacer("{username}", username, "{clientid}", clientID).Replace(c.getResponseTemplate())
 }
 
-func (c *MqttConfig) GetServer() string {
-	return fmt.Sprintf("mqtt://%s:%d", c.Host, c.Port)
+// ParseResponse takes the username and client id out of a response topic. It reports false if the topic is not laid
+// out as a response topic, where each of them is one level
+func (c *TopicsConfig) ParseResponse(topic string) (username string, clientID string, ok bool) {
+
+	templateLevels := strings.Split(c.getResponseTemplate(), "/")
+	topicLevels := strings.Split(topic, "/")
+	if len(templateLevels) != len(topicLevels) {
+		return "", "", false
+	}
+
+	for i, level := range templateLevels {
+		switch level {
+		case "{username}":
+			username = topicLevels[i]
+		case "{clientid}":
+			clientID = topicLevels[i]
+		default:
+			if level != topicLevels[i] {
+				return "", "", false
+			}
+		}
+	}
+
+	if username == "" || clientID == "" || strings.ContainsAny(username+clientID, "+#") {
+		return "", "", false
+	}
+	return username, clientID, true
+}
+
+func (c *TopicsConfig) getResponseTemplate() string {
+	template := c.Response
+	if template == "" {
+		template = "response/{username}/{clientid}"
+	}
+	return c.GetTopic(template)
+}
+
+func (c *TopicsConfig) GetStatus(clientID string) string {
+	template := c.Status
+	if template == "" {
+		template = "status/{clientid}"
+	}
+	return strings.ReplaceAll(c.GetTopic(template), "{clientid}", clientID)
+}
+
+func (c *DeadLetterConfig) GetTopic() string {
+	if c.Topic == "" {
+		return "deadletter"
+	}
+	return c.Topic
+}
+
+func (c *RateLimitConfig) GetMaxClients() int {
+	if c.MaxClients <= 0 {
+		return 10000
+	}
+	return c.MaxClients
+}
+
+func (c *DeadLetterConfig) GetExpiry() (time.Duration, error) {
+	return parseDuration(c.Expiry, 7*24*time.Hour)
+}
+
+func (c *DeadLetterConfig) GetRateLimit() *RateLimit {
+	if c.RateLimit == nil {
+		return &RateLimit{Rate: 1, Burst: 10}
+	}
+	return c.RateLimit
+}
+
+func (c *SchedulerConfig) GetWorkers() int {
+	if c.Workers <= 0 {
+		return 1
+	}
+	return c.Workers
+}
+
+func (c *SchedulerConfig) GetQueueSize() int {
+	if c.QueueSize <= 0 {
+		return 1000
+	}
+	return c.QueueSize
+}
+
+func (c *SchedulerConfig) GetAging() (time.Duration, error) {
+	if c.Aging == "" {
+		return 5 * time.Second, nil
+	}
+	return time.ParseDuration(c.Aging)
+}
+
+func (c *AuthConfig) GetLeeway() (time.Duration, error) {
+	if c.Leeway == "" {
+		return 30 * time.Second, nil
+	}
+	return time.ParseDuration(c.Leeway)
+}
+
+func (c *SigningConfig) GetWindow() (time.Duration, error) {
+	return parseDuration(c.Window, 5*time.Minute)
+}
+
+func (c *DynamicSecurityConfig) GetTopic() string {
+	if c.Topic == "" {
+		return "$CONTROL/dynamic-security/v1"
+	}
+	return c.Topic
+}
+
+func (c *DynamicSecurityConfig) GetResponseTopic() string {
+	return c.GetTopic() + "/response"
+}
+
+func (c *DynamicSecurityConfig) GetRolePrefix() string {
+	if c.RolePrefix == "" {
+		return "diaries-"
+	}
+	return c.RolePrefix
+}
+
+func (c *DynamicSecurityConfig) GetTimeout() (time.Duration, error) {
+	return parseDuration(c.Timeout, 5*time.Second)
+}
+
+func (c *LoggingConfig) GetPayloads() string {
+	if c.Payloads == "" {
+		return "off"
+	}
+	return c.Payloads
+}
+
+func (c *LoggingConfig) GetPayloadLimit() int {
+	if c.PayloadLimit <= 0 {
+		return 256
+	}
+	return c.PayloadLimit
+}
+
+func (c *UsersConfig) GetMaxFailures() int {
+	if c.MaxFailures <= 0 {
+		return 5
+	}
+	return c.MaxFailures
+}
+
+func (c *UsersConfig) GetLockoutDuration() (time.Duration, error) {
+	return parseDuration(c.LockoutDuration, 15*time.Minute)
+}
+
+func (c *UsersConfig) GetAccessTokenExpiry() (time.Duration, error) {
+	return parseDuration(c.AccessTokenExpiry, 15*time.Minute)
+}
+
+func (c *UsersConfig) GetRefreshTokenExpiry() (time.Duration, error) {
+	return parseDuration(c.RefreshTokenExpiry, 24*time.Hour)
+}
+
+func parseDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(value)
 }
 
 func (c *DBConfig) DriverName() string {
 	return c.Go.Driver
 }
 
+// Memory reports whether the data is kept in memory rather than in a database
+func (c *DBConfig) Memory() bool {
+	return c.Go.Driver == "memory"
+}
+
+// ConnectionString includes the password, so it must not be logged
 func (c *DBConfig) ConnectionString(database string) string {
 	connectionString := fmt.Sprintf("host=%s port=%d user=%s password=%s",
-		c.Host, c.Port, c.Username, c.Password)
+		quote(c.Host), c.Port, quote(c.Username), quote(c.Password.Value()))
 
 	if database != "" {
-		return fmt.Sprintf("%s dbname=%s", connectionString, database)
+		connectionString = fmt.Sprintf("%s dbname=%s", connectionString, quote(database))
 	}
 
-	return connectionString
+	if c.SSLMode != "" {
+		connectionString = fmt.Sprintf("%s sslmode=%s", connectionString, quote(c.SSLMode))
+	}
+
+	if c.SSLRootCert != "" {
+		connectionString = fmt.Sprintf("%s sslrootcert=%s", connectionString, quote(c.SSLRootCert))
+	}
+
+	// The driver takes the timeout in whole seconds
+	if timeout, err := c.GetConnectTimeout(); err == nil {
+		connectionString = fmt.Sprintf("%s connect_timeout=%d", connectionString, int(math.Ceil(timeout.Seconds())))
+	}
+
+	return fmt.Sprintf("%s application_name=%s", connectionString, quote(c.GetApplicationName()))
+}
+
+func (c *DBConfig) GetConnectTimeout() (time.Duration, error) {
+	return parseDuration(c.ConnectTimeout, 10*time.Second)
+}
+
+func (c *DBConfig) GetApplicationName() string {
+	if c.ApplicationName == "" {
+		return "diaries"
+	}
+	return c.ApplicationName
+}
+
+func (c *DBConfig) GetStartupTimeout() (time.Duration, error) {
+	return parseDuration(c.StartupTimeout, 30*time.Second)
+}
+
+// quote makes a value safe to put in a connection string, even if it contains spaces or quotes
+func quote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
 }
 
 // func (c *DBConfig) GetJdbcUrl() string {
@@ -66,26 +558,13 @@ func (c *DBConfig) ConnectionString(database string) string {
 // 		c.Host, c.Port, c.Username, c.Password, c.Database)
 // }
 
-func Read() (*Config, error) {
+// Dir returns the directory which holds the user's diaries files
+func Dir() (string, error) {
 	dirname, err := os.UserHomeDir()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-
-	filename := filepath.Join(dirname, ".diaries", "responder.json")
-
-	configFile, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-
-	var config Config
-	jsonParser := json.NewDecoder(configFile)
-	if err = jsonParser.Decode(&config); err != nil {
-		return nil, err
-	}
-
-	return &config, nil
+	return filepath.Join(dirname, ".diaries"), nil
 }
 
 func (c *Config) Print() {
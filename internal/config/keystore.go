@@ -0,0 +1,142 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// KeystoreConfig locates the encrypted keystore. Its key is taken from the DIARIES_KEYSTORE_KEY environment
+// variable, or else the key file
+type KeystoreConfig struct {
+	File    string `json:"file"`    // Defaults to ~/.diaries/keystore
+	KeyFile string `json:"keyFile"` // File containing the base64 256 bit key
+}
+
+func (c *KeystoreConfig) GetFile() (string, error) {
+	if c.File != "" {
+		return c.File, nil
+	}
+	dirname, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dirname, "keystore"), nil
+}
+
+// Keystore holds named secrets in a file encrypted with AES-256-GCM
+type Keystore struct {
+	filename string
+	aead     cipher.AEAD
+	entries  map[string]string
+}
+
+// OpenKeystore reads the keystore. A keystore which does not exist yet is empty
+func OpenKeystore(c *KeystoreConfig) (*Keystore, error) {
+
+	filename, err := c.GetFile()
+	if err != nil {
+		return nil, err
+	}
+
+	text, ok := os.LookupEnv("DIARIES_KEYSTORE_KEY")
+	if !ok {
+		if c.KeyFile == "" {
+			return nil, fmt.Errorf("keystore: no key, set DIARIES_KEYSTORE_KEY or keystore.keyFile")
+		}
+		bytes, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("keystore: %w", err)
+		}
+		text = string(bytes)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("keystore: the key must be 32 base64 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &Keystore{filename: filename, aead: aead, entries: map[string]string{}}
+
+	sealed, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keystore: %w", err)
+	}
+
+	size := aead.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("keystore %s: the file is too short", filename)
+	}
+	plaintext, err := aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("keystore %s: could not decrypt, is it the right key?", filename)
+	}
+	if err := json.Unmarshal(plaintext, &ks.entries); err != nil {
+		return nil, fmt.Errorf("keystore %s: %w", filename, err)
+	}
+
+	return ks, nil
+}
+
+func (ks *Keystore) Get(name string) (string, bool) {
+	value, ok := ks.entries[name]
+	return value, ok
+}
+
+func (ks *Keystore) Set(name string, value string) {
+	ks.entries[name] = value
+}
+
+func (ks *Keystore) Remove(name string) {
+	delete(ks.entries, name)
+}
+
+// Names lists the entries, in order
+func (ks *Keystore) Names() []string {
+	names := make([]string, 0, len(ks.entries))
+	for name := range ks.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Save encrypts the keystore and writes it, readable only by its owner
+func (ks *Keystore) Save() error {
+
+	plaintext, err := json.Marshal(ks.entries)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, ks.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ks.filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(ks.filename, ks.aead.Seal(nonce, nonce, plaintext, nil), 0600)
+}
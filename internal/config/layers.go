@@ -0,0 +1,431 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//go:embed defaults.json
+var defaults []byte
+
+// The --config flag. Commands parse their flags before reading the configuration
+var file = flag.String("config", "", "The configuration file, instead of the user and local files. Defaults to $DIARIES_CONFIG")
+
+const envPrefix = "DIARIES_"
+
+// Loaded is the configuration together with where each value came from
+type Loaded struct {
+	Config  *Config
+	Files   []string          // The files which were read, lowest precedence first
+	Sources map[string]string // Where each value was set, by its path, e.g. "mqtt.host"
+}
+
+type layer struct {
+	name     string
+	filename string
+	required bool
+}
+
+// layers are the configuration files, lowest precedence first. A file given with --config or DIARIES_CONFIG
+// takes the place of the user and local files, so several environments can be kept apart on one machine
+func layers() ([]layer, error) {
+
+	list := []layer{{name: "system", filename: systemFile()}}
+
+	filename := *file
+	if filename == "" {
+		filename = os.Getenv("DIARIES_CONFIG")
+	}
+	if filename != "" {
+		return append(list, layer{name: "config", filename: filename, required: true}), nil
+	}
+
+	dirname, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(list,
+		layer{name: "user", filename: filepath.Join(dirname, "responder.json")},
+		layer{name: "local", filename: "diaries.json"},
+	), nil
+}
+
+func systemFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "diaries", "config.json")
+	}
+	return "/etc/diaries/config.json"
+}
+
+func Read() (*Config, error) {
+	loaded, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return loaded.Config, nil
+}
+
+// Load merges the built in defaults, the configuration files and then the DIARIES_ environment variables,
+// each overriding the one before. It then validates the result, and loads the secrets it refers to
+func Load() (*Loaded, error) {
+	return load(true)
+}
+
+// LoadWithoutSecrets leaves the secrets given as references unloaded, for the commands which look after the
+// secrets, or show the configuration, and must work before the secrets are in place
+func LoadWithoutSecrets() (*Loaded, error) {
+	return load(false)
+}
+
+func load(resolve bool) (*Loaded, error) {
+
+	loaded := &Loaded{Sources: map[string]string{}}
+	merged := map[string]interface{}{}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(defaults, &values); err != nil {
+		return nil, fmt.Errorf("built in defaults: %w", err)
+	}
+	merge(merged, values, "", "default", loaded.Sources)
+
+	list, err := layers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range list {
+		bytes, err := os.ReadFile(l.filename)
+		if errors.Is(err, fs.ErrNotExist) && !l.required {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var values map[string]interface{}
+		if err := json.Unmarshal(bytes, &values); err != nil {
+			return nil, fmt.Errorf("%s: %w", l.filename, err)
+		}
+		merge(merged, values, "", l.filename, loaded.Sources)
+		loaded.Files = append(loaded.Files, l.filename)
+	}
+
+	for _, field := range fields() {
+		name := envName(field.path)
+		text, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		value, err := parseEnv(text, field.typ)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		set(merged, field.path, value)
+		setSource(loaded.Sources, field.path, "env "+name)
+	}
+
+	bytes, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(bytes, &config); err != nil {
+		return nil, err
+	}
+
+	v := config.validate()
+	for _, path := range v.defaulted {
+		setSource(loaded.Sources, path, "default")
+	}
+	if len(v.problems) > 0 {
+		return nil, &ValidationError{Problems: v.problems}
+	}
+
+	if resolve {
+		if err := config.resolveSecrets(); err != nil {
+			return nil, err
+		}
+	}
+	loaded.Config = &config
+
+	return loaded, nil
+}
+
+// merge copies the values into dst. Objects are merged, anything else replaces what was there
+func merge(dst map[string]interface{}, src map[string]interface{}, prefix string, source string, sources map[string]string) {
+	for key, value := range src {
+		path := join(prefix, key)
+		if object, ok := value.(map[string]interface{}); ok {
+			if existing, ok := dst[key].(map[string]interface{}); ok {
+				merge(existing, object, path, source, sources)
+				continue
+			}
+			dst[key] = map[string]interface{}{}
+			merge(dst[key].(map[string]interface{}), object, path, source, sources)
+			continue
+		}
+		dst[key] = value
+		setSource(sources, path, source)
+	}
+}
+
+func set(dst map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := dst[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			dst[key] = next
+		}
+		dst = next
+	}
+	dst[keys[len(keys)-1]] = value
+}
+
+// setSource records where the value at the path came from, replacing the sources of any values under it
+func setSource(sources map[string]string, path string, source string) {
+	for p := range sources {
+		if strings.HasPrefix(p, path+".") {
+			delete(sources, p)
+		}
+	}
+	sources[path] = source
+}
+
+// Source says where the value at the path came from
+func (l *Loaded) Source(path string) string {
+
+	if source, ok := l.Sources[path]; ok {
+		return source
+	}
+
+	set := map[string]bool{}
+	for p, source := range l.Sources {
+		if strings.HasPrefix(p, path+".") {
+			set[source] = true
+		}
+	}
+	if len(set) == 0 {
+		return ""
+	}
+
+	list := []string{}
+	for source := range set {
+		list = append(list, source)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+func join(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+type field struct {
+	path string
+	typ  reflect.Type
+}
+
+// fields lists the settings, by their path in the configuration file. Structs are followed into; anything else,
+// including lists and maps, is a single setting
+func fields() []field {
+	var list []field
+	walkType(reflect.TypeOf(Config{}), "", &list)
+	return list
+}
+
+func walkType(t reflect.Type, prefix string, list *[]field) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		typ := f.Type
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+
+		if f.Anonymous && name == "" {
+			walkType(typ, prefix, list)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		path := join(prefix, name)
+		if typ.Kind() == reflect.Struct && typ != secretType {
+			walkType(typ, path, list)
+			continue
+		}
+		*list = append(*list, field{path: path, typ: typ})
+	}
+}
+
+// envName turns a path into the name of the environment variable which overrides it, e.g. "deadLetter.topic"
+// into DIARIES_DEAD_LETTER_TOPIC
+func envName(path string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, key := range strings.Split(path, ".") {
+		if i > 0 {
+			b.WriteByte('_')
+		}
+		runes := []rune(key)
+		for j, r := range runes {
+			if j > 0 && unicode.IsUpper(r) && !unicode.IsUpper(runes[j-1]) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+// parseEnv converts the text of an environment variable to the value the setting needs. Lists and maps are
+// given as JSON
+func parseEnv(text string, t reflect.Type) (interface{}, error) {
+	if t == secretType {
+		return text, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return text, nil
+	case reflect.Bool:
+		return strconv.ParseBool(text)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(text, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(text, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(text, 64)
+	default:
+		var value interface{}
+		if err := json.Unmarshal([]byte(text), &value); err != nil {
+			return nil, fmt.Errorf("expected JSON: %w", err)
+		}
+		return value, nil
+	}
+}
+
+// Setting is one value of the configuration and where it came from
+type Setting struct {
+	Path   string
+	Env    string
+	Value  interface{}
+	Source string
+}
+
+// Effective lists every setting, with the value in use and where it came from. Settings which were not set
+// anywhere have no source
+func (l *Loaded) Effective() []Setting {
+
+	var list []Setting
+	value := reflect.ValueOf(*l.Config)
+	for _, f := range fields() {
+		list = append(list, Setting{
+			Path:   f.path,
+			Env:    envName(f.path),
+			Value:  lookup(value, f.path),
+			Source: l.Source(f.path),
+		})
+	}
+	return list
+}
+
+// lookup follows the path through the configuration, by the json names of the fields
+func lookup(v reflect.Value, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		v = fieldByName(v, key)
+		if !v.IsValid() {
+			return nil
+		}
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	return v.Interface()
+}
+
+func fieldByName(v reflect.Value, key string) reflect.Value {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" {
+			if found := fieldByName(v.Field(i), key); found.IsValid() {
+				return found
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if name == key {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// Changed lists the settings which differ between the two configurations, by their paths
+func Changed(before *Config, after *Config) []string {
+
+	var list []string
+	b, a := reflect.ValueOf(*before), reflect.ValueOf(*after)
+	for _, f := range fields() {
+		if !reflect.DeepEqual(lookup(b, f.path), lookup(a, f.path)) {
+			list = append(list, f.path)
+		}
+	}
+	return list
+}
+
+// Keep sets the settings at the given paths back to the values they have in the other configuration, leaving the
+// rest of the configuration as it is
+func Keep(c *Config, from *Config, paths []string) {
+	for _, path := range paths {
+		dst, src := reflect.ValueOf(c).Elem(), reflect.ValueOf(*from)
+		for _, key := range strings.Split(path, ".") {
+			dst, src = fieldByName(dst, key), fieldByName(src, key)
+			if !dst.IsValid() || !src.IsValid() {
+				break
+			}
+		}
+		if dst.IsValid() && src.IsValid() && dst.CanSet() {
+			dst.Set(src)
+		}
+	}
+}
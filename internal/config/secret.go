@@ -0,0 +1,167 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// Secret is a password or key. In the configuration it is either the value itself or a reference to where the
+// value is kept:
+//
+//	"file:/run/secrets/db_password"  the content of the file, without surrounding white space
+//	"env:DB_PASSWORD"                the environment variable
+//	"keystore:db"                    the entry in the encrypted keystore
+//
+// The value is never shown when the secret is printed, logged, marshalled or included in an error. A reference
+// is shown as it is, since it is not itself secret
+type Secret struct {
+	ref   string
+	value string
+}
+
+func NewSecret(value string) Secret {
+	return Secret{value: value}
+}
+
+// Value returns the secret itself. Only pass it to what needs it
+func (s Secret) Value() string {
+	return s.value
+}
+
+func (s Secret) IsSet() bool {
+	return s.value != ""
+}
+
+// given reports whether there is a value or a reference, before the reference is loaded
+func (s Secret) given() bool {
+	return s.ref != "" || s.value != ""
+}
+
+func (s Secret) String() string {
+	if s.ref != "" {
+		return s.ref
+	}
+	if s.value != "" {
+		return redacted
+	}
+	return ""
+}
+
+func (s Secret) GoString() string {
+	return fmt.Sprintf("config.Secret(%q)", s.String())
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("a secret must be a string")
+	}
+	*s = Secret{}
+	for _, prefix := range []string{"file:", "env:", "keystore:"} {
+		if strings.HasPrefix(text, prefix) {
+			s.ref = text
+			return nil
+		}
+	}
+	s.value = text
+	return nil
+}
+
+// resolve loads the value of a reference
+func (s *Secret) resolve(keystore func() (*Keystore, error)) error {
+
+	kind, name, _ := strings.Cut(s.ref, ":")
+	switch kind {
+	case "":
+		return nil
+
+	case "file":
+		bytes, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", s.ref, err)
+		}
+		s.value = strings.TrimSpace(string(bytes))
+
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return fmt.Errorf("secret %s: the environment variable is not set", s.ref)
+		}
+		s.value = value
+
+	case "keystore":
+		ks, err := keystore()
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", s.ref, err)
+		}
+		value, ok := ks.Get(name)
+		if !ok {
+			return fmt.Errorf("secret %s: not in the keystore", s.ref)
+		}
+		s.value = value
+	}
+
+	return nil
+}
+
+var secretType = reflect.TypeOf(Secret{})
+
+// resolveSecrets loads the value of every secret given as a reference. The keystore is only opened if a secret
+// needs it
+func (c *Config) resolveSecrets() error {
+
+	var ks *Keystore
+	keystore := func() (*Keystore, error) {
+		if ks != nil {
+			return ks, nil
+		}
+		var err error
+		ks, err = OpenKeystore(&c.Keystore)
+		return ks, err
+	}
+
+	return walkSecrets(reflect.ValueOf(c).Elem(), func(s *Secret) error {
+		return s.resolve(keystore)
+	})
+}
+
+func walkSecrets(v reflect.Value, fn func(*Secret) error) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() == secretType {
+			return fn(v.Addr().Interface().(*Secret))
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				if err := walkSecrets(v.Field(i), fn); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return walkSecrets(v.Elem(), fn)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkSecrets(v.Index(i), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
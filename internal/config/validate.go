@@ -0,0 +1,422 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/scheduler"
+)
+
+// Default ports of the brokers, by scheme, and of the database
+var defaultPorts = map[string]int{"mqtt": 1883, "mqtts": 8883, "ws": 80, "wss": 443}
+
+const (
+	defaultDBPort   = 5432
+	defaultDBDriver = "postgres"
+)
+
+// Problem is something wrong with one setting, given by its path, e.g. "mqtt.brokers[1].port"
+type Problem struct {
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError lists every problem found, so they can all be put right at once
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = "    " + p.String()
+	}
+	return fmt.Sprintf("invalid configuration:\n%s", strings.Join(lines, "\n"))
+}
+
+type validator struct {
+	problems  []Problem
+	defaulted []string
+}
+
+func (v *validator) problem(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) duration(path string, value string) {
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		v.problem(path, "not a duration, e.g. 30s or 15m: %q", value)
+		return
+	}
+	if d < 0 {
+		v.problem(path, "must not be negative")
+	}
+}
+
+func (v *validator) level(path string, value string) {
+	switch strings.ToLower(value) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		v.problem(path, "must be debug, info, warn or error, not %q", value)
+	}
+}
+
+func (v *validator) topic(path string, topic string) {
+	if strings.ContainsAny(topic, "+#") {
+		v.problem(path, "must not contain the wildcards + or #")
+	}
+}
+
+// wholeLevel reports whether the placeholder appears once in the topic, as a level of its own
+func wholeLevel(topic string, placeholder string) bool {
+	if strings.Count(topic, placeholder) != 1 {
+		return false
+	}
+	for _, level := range strings.Split(topic, "/") {
+		if level == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) file(path string, filename string) {
+	if filename == "" {
+		return
+	}
+	if _, err := os.Stat(filename); err != nil {
+		v.problem(path, "cannot read %s", filename)
+	}
+}
+
+func (v *validator) base64(path string, value string, size int) {
+	bytes, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		v.problem(path, "not base64")
+		return
+	}
+	if size > 0 && len(bytes) != size {
+		v.problem(path, "must be %d bytes, not %d", size, len(bytes))
+	}
+}
+
+// Validate fills in the documented defaults which the rest of the code relies on, such as the ports and the
+// database driver, and then checks the settings. It returns a *ValidationError listing every problem
+func (c *Config) Validate() error {
+	v := c.validate()
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+func (c *Config) validate() *validator {
+	v := new(validator)
+
+	if len(c.Mqtt.Brokers) == 0 {
+		c.validateBroker(v, "mqtt", &c.Mqtt.BrokerConfig)
+	}
+	for i := range c.Mqtt.Brokers {
+		c.validateBroker(v, fmt.Sprintf("mqtt.brokers[%d]", i), &c.Mqtt.Brokers[i])
+	}
+	for i, b := range c.Mqtt.Brokers {
+		if b.Username != c.Mqtt.Brokers[0].Username {
+			v.problem(fmt.Sprintf("mqtt.brokers[%d].username", i), "must be the same on every broker, as it names the response topic")
+		}
+	}
+	v.duration("mqtt.failback", c.Mqtt.Failback)
+	if c.Mqtt.QoS != nil && *c.Mqtt.QoS > 2 {
+		v.problem("mqtt.qos", "must be 0, 1 or 2")
+	}
+
+	if c.Topics.Response != "" && !(wholeLevel(c.Topics.Response, "{username}") && wholeLevel(c.Topics.Response, "{clientid}")) {
+		v.problem("topics.response", "must include {username} and {clientid} once each, as levels of their own, so each client gets its own replies")
+	}
+	v.topic("topics.response", c.Topics.Response)
+	v.topic("topics.prefix", c.Topics.Prefix)
+	v.topic("topics.request", c.Topics.Request)
+	v.topic("deadLetter.topic", c.DeadLetter.Topic)
+	v.duration("deadLetter.expiry", c.DeadLetter.Expiry)
+	validateRateLimit(v, "deadLetter.rateLimit", c.DeadLetter.RateLimit)
+
+	c.validateDB(v)
+	c.validateAuth(v)
+	c.validateEncryption(v)
+	c.validateSigning(v)
+
+	v.duration("users.lockoutDuration", c.Users.LockoutDuration)
+	v.duration("users.accessTokenExpiry", c.Users.AccessTokenExpiry)
+	v.duration("users.refreshTokenExpiry", c.Users.RefreshTokenExpiry)
+	if c.Users.MaxFailures < 0 {
+		v.problem("users.maxFailures", "must not be negative")
+	}
+
+	c.validateLogging(v)
+
+	validateRateLimit(v, "rateLimits.client", c.RateLimits.Client)
+	validateRateLimit(v, "rateLimits.function", c.RateLimits.Function)
+	for _, function := range sortedKeys(c.RateLimits.Functions) {
+		limit := c.RateLimits.Functions[function]
+		validateRateLimit(v, "rateLimits.functions."+function, &limit)
+	}
+	if c.RateLimits.MaxClients < 0 {
+		v.problem("rateLimits.maxClients", "must not be negative")
+	}
+
+	if c.Scheduler.Workers < 0 {
+		v.problem("scheduler.workers", "must not be negative")
+	}
+	if c.Scheduler.QueueSize < 0 {
+		v.problem("scheduler.queueSize", "must not be negative")
+	}
+	v.duration("scheduler.aging", c.Scheduler.Aging)
+	for _, function := range sortedKeys(c.Scheduler.Priorities) {
+		// Checked as the Responder reads it, so any case is accepted
+		priority := c.Scheduler.Priorities[function]
+		if _, err := scheduler.ParsePriority(priority); err != nil {
+			v.problem("scheduler.priorities."+function, "must be low, normal or high, not %q", priority)
+		}
+	}
+
+	v.file("keystore.keyFile", c.Keystore.KeyFile)
+	v.duration("dynamicSecurity.timeout", c.DynamicSecurity.Timeout)
+
+	return v
+}
+
+func (c *Config) validateBroker(v *validator, path string, b *BrokerConfig) {
+	port, ok := defaultPorts[b.GetScheme()]
+	if !ok {
+		v.problem(path+".scheme", "must be mqtt, mqtts, ws or wss, not %q", b.Scheme)
+	}
+	if b.Host == "" {
+		v.problem(path+".host", "is required")
+	}
+	if b.Port == 0 && ok {
+		b.Port = port
+		v.defaulted = append(v.defaulted, path+".port")
+	}
+	if b.Port < 0 || b.Port > 65535 {
+		v.problem(path+".port", "must be between 1 and 65535")
+	}
+
+	if b.UsesTLS() {
+		v.file(path+".tls.caFile", b.TLS.CAFile)
+		v.file(path+".tls.certFile", b.TLS.CertFile)
+		v.file(path+".tls.keyFile", b.TLS.KeyFile)
+		if (b.TLS.CertFile == "") != (b.TLS.KeyFile == "") {
+			v.problem(path+".tls", "certFile and keyFile go together")
+		}
+	}
+}
+
+func (c *Config) validateDB(v *validator) {
+	if c.Db.Go.Driver == "" {
+		c.Db.Go.Driver = defaultDBDriver
+		v.defaulted = append(v.defaulted, "db.go.driver")
+	}
+	switch c.Db.Go.Driver {
+	case "postgres":
+		if c.Db.Seed != "" {
+			v.problem("db.seed", "is only loaded by the memory driver")
+		}
+	case "memory":
+		v.file("db.seed", c.Db.Seed)
+		return
+	default:
+		v.problem("db.go.driver", "must be postgres or memory, not %q", c.Db.Go.Driver)
+	}
+	if c.Db.Port == 0 {
+		c.Db.Port = defaultDBPort
+		v.defaulted = append(v.defaulted, "db.port")
+	}
+	if c.Db.Port < 0 || c.Db.Port > 65535 {
+		v.problem("db.port", "must be between 1 and 65535")
+	}
+	if c.Db.Host == "" {
+		v.problem("db.host", "is required")
+	}
+	switch c.Db.SSLMode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		v.problem("db.sslMode", "must be disable, require, verify-ca or verify-full, not %q", c.Db.SSLMode)
+	}
+	v.file("db.sslRootCert", c.Db.SSLRootCert)
+	v.duration("db.connectTimeout", c.Db.ConnectTimeout)
+	v.duration("db.startupTimeout", c.Db.StartupTimeout)
+	if c.Db.Pool.MaxOpenConns < 0 {
+		v.problem("db.pool.maxOpenConns", "must not be negative")
+	}
+	if c.Db.Pool.MaxIdleConns < 0 {
+		v.problem("db.pool.maxIdleConns", "must not be negative")
+	}
+	v.duration("db.pool.connMaxLifetime", c.Db.Pool.ConnMaxLifetime)
+	v.duration("db.pool.connMaxIdleTime", c.Db.Pool.ConnMaxIdleTime)
+}
+
+func (c *Config) validateAuth(v *validator) {
+	v.duration("auth.leeway", c.Auth.Leeway)
+	if c.Auth.Required && len(c.Auth.Keys) == 0 {
+		v.problem("auth.keys", "at least one key is required when auth.required is set")
+	}
+
+	ids := map[string]bool{}
+	for i, key := range c.Auth.Keys {
+		path := fmt.Sprintf("auth.keys[%d]", i)
+		if key.ID == "" {
+			v.problem(path+".id", "is required")
+		} else if ids[key.ID] {
+			v.problem(path+".id", "%q is used twice", key.ID)
+		}
+		ids[key.ID] = true
+
+		switch key.Algorithm {
+		case "HS256":
+			if !key.Secret.given() {
+				v.problem(path+".secret", "is required for HS256")
+			}
+		case "EdDSA":
+			if key.PublicKey == "" && !key.PrivateKey.given() {
+				v.problem(path, "an EdDSA key needs a publicKey or a privateKey")
+			}
+			if key.PublicKey != "" {
+				v.base64(path+".publicKey", key.PublicKey, ed25519.PublicKeySize)
+			}
+			// A private key given as a reference is checked when it is loaded
+			if key.PrivateKey.IsSet() {
+				v.base64(path+".privateKey", key.PrivateKey.Value(), ed25519.SeedSize)
+				if !keysMatch(key.PrivateKey.Value(), key.PublicKey) {
+					v.problem(path+".publicKey", "does not match the privateKey")
+				}
+			}
+		default:
+			v.problem(path+".algorithm", "must be HS256 or EdDSA, not %q", key.Algorithm)
+		}
+	}
+}
+
+// keysMatch reports whether the Ed25519 public key is the one of the private key's seed. Keys which cannot be decoded
+// are reported by themselves, so they are not a mismatch
+func keysMatch(seed string, publicKey string) bool {
+	s, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil || len(s) != ed25519.SeedSize {
+		return true
+	}
+	p, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(p) != ed25519.PublicKeySize {
+		return true
+	}
+	return ed25519.NewKeyFromSeed(s).Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(p))
+}
+
+func (c *Config) validateEncryption(v *validator) {
+	if c.Encryption.Required && len(c.Encryption.Keys) == 0 {
+		v.problem("encryption.keys", "at least one key is required when encryption.required is set")
+	}
+
+	ids := map[string]bool{}
+	for i, key := range c.Encryption.Keys {
+		path := fmt.Sprintf("encryption.keys[%d]", i)
+		if key.ID == "" {
+			v.problem(path+".id", "is required")
+		} else if ids[key.ID] {
+			v.problem(path+".id", "%q is used twice", key.ID)
+		}
+		ids[key.ID] = true
+
+		if key.Key.given() == (key.File != "") {
+			v.problem(path, "give either key or file")
+		}
+		v.file(path+".file", key.File)
+	}
+}
+
+func (c *Config) validateSigning(v *validator) {
+	v.duration("signing.window", c.Signing.Window)
+
+	if key := c.Signing.Key; key != nil {
+		if key.ID == "" {
+			v.problem("signing.key.id", "is required")
+		}
+		if key.PrivateKey.given() == (key.File != "") {
+			v.problem("signing.key", "give either privateKey or file")
+		}
+		v.file("signing.key.file", key.File)
+	} else if c.Signing.SignReplies {
+		v.problem("signing.key", "is required when signing.signReplies is set")
+	}
+
+	if c.Signing.Required && len(c.Signing.Trusted) == 0 {
+		v.problem("signing.trusted", "at least one key is required when signing.required is set")
+	}
+	for i, key := range c.Signing.Trusted {
+		path := fmt.Sprintf("signing.trusted[%d]", i)
+		if key.ID == "" {
+			v.problem(path+".id", "is required")
+		}
+		if key.PublicKey == "" {
+			v.problem(path+".publicKey", "is required")
+		} else {
+			v.base64(path+".publicKey", key.PublicKey, 32)
+		}
+	}
+}
+
+func (c *Config) validateLogging(v *validator) {
+	switch c.Logging.Format {
+	case "", "text", "json":
+	default:
+		v.problem("logging.format", "must be text or json, not %q", c.Logging.Format)
+	}
+	v.level("logging.level", c.Logging.Level)
+	for _, component := range sortedKeys(c.Logging.Levels) {
+		switch component {
+		case "mqtt", "db", "handlers":
+			v.level("logging.levels."+component, c.Logging.Levels[component])
+		default:
+			v.problem("logging.levels."+component, "not a component; they are mqtt, db and handlers")
+		}
+	}
+	switch c.Logging.Payloads {
+	case "", "off", "truncated", "full":
+	default:
+		v.problem("logging.payloads", "must be off, truncated or full, not %q", c.Logging.Payloads)
+	}
+	if c.Logging.PayloadLimit < 0 {
+		v.problem("logging.payloadLimit", "must not be negative")
+	}
+}
+
+func validateRateLimit(v *validator, path string, limit *RateLimit) {
+	if limit == nil {
+		return
+	}
+	if limit.Rate < 0 {
+		v.problem(path+".rate", "must not be negative")
+	}
+	if limit.Burst < 0 {
+		v.problem(path+".burst", "must not be negative")
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,235 @@
+package connection
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+type broker struct {
+	config    config.BrokerConfig
+	url       *url.URL
+	tlsConfig *tls.Config
+	webSocket *autopaho.WebSocketConfig
+}
+
+// brokers connects to the first broker in the list which is available. autopaho tries the urls in order
+// every time it reconnects, so dropping the connection to a fallback broker is enough to fail back
+type brokers struct {
+	list  []*broker
+	byUrl map[*url.URL]*broker
+
+	mutex   sync.Mutex
+	current *broker
+	conn    net.Conn
+}
+
+var (
+	currentMutex  sync.Mutex
+	currentServer string
+)
+
+// Current returns the broker this process is connected to
+func Current() string {
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
+	return currentServer
+}
+
+func newBrokers(configs []config.BrokerConfig) (*brokers, error) {
+
+	b := new(brokers)
+	b.byUrl = make(map[*url.URL]*broker)
+
+	for _, c := range configs {
+		serverUrl, err := parseServer(&c)
+		if err != nil {
+			return nil, err
+		}
+
+		item := &broker{config: c, url: serverUrl}
+
+		if c.UsesTLS() {
+			item.tlsConfig, err = NewTLSConfig(&c.TLS)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if c.UsesWebSocket() {
+			item.webSocket, err = NewWebSocketConfig(&c.WebSocket)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		b.list = append(b.list, item)
+		b.byUrl[serverUrl] = item
+	}
+
+	return b, nil
+}
+
+func (b *brokers) urls() []*url.URL {
+	urls := make([]*url.URL, len(b.list))
+	for i, item := range b.list {
+		urls[i] = item.url
+	}
+	return urls
+}
+
+// attemptConnection opens a network connection to one broker, with that broker's TLS and websocket settings
+func (b *brokers) attemptConnection(ctx context.Context, cfg autopaho.ClientConfig, u *url.URL) (net.Conn, error) {
+
+	item := b.byUrl[u]
+	if item == nil {
+		return nil, fmt.Errorf("unexpected broker: %s", u)
+	}
+
+	conn, err := item.dial(ctx, cfg.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mutex.Lock()
+	b.current = item
+	b.conn = conn
+	b.mutex.Unlock()
+
+	currentMutex.Lock()
+	currentServer = item.config.GetServer()
+	currentMutex.Unlock()
+
+	logger.Info(fmt.Sprintf("connected to broker: %s", item.config.GetServer()))
+	return conn, nil
+}
+
+func (item *broker) dial(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+
+	switch item.config.GetScheme() {
+	case "mqtt":
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", item.url.Host)
+		if err == nil {
+			conn = packets.NewThreadSafeConn(conn)
+		}
+	case "mqtts":
+		d := tls.Dialer{Config: item.tlsConfig}
+		conn, err = d.DialContext(ctx, "tcp", item.url.Host)
+		if err == nil {
+			conn = packets.NewThreadSafeConn(conn)
+		}
+	case "ws", "wss":
+		conn, err = dialWebSocket(ctx, item.webSocket, item.tlsConfig, item.url)
+	}
+	return conn, err
+}
+
+// buildConnectPacket logs on with the credentials of the broker being connected to
+func (b *brokers) buildConnectPacket(cp *paho.Connect, u *url.URL) *paho.Connect {
+
+	item := b.byUrl[u]
+	if item == nil {
+		return cp
+	}
+
+	cp.Username = item.config.Username
+	cp.UsernameFlag = item.config.Username != ""
+	cp.Password = []byte(item.config.Password.Value())
+	cp.PasswordFlag = item.config.Password.IsSet()
+	return cp
+}
+
+// probe logs on to the broker with a throwaway client id and a clean session, and logs off again, to check that it
+// accepts connections rather than just that its port is open
+func (item *broker) probe(ctx context.Context, clientID string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	conn, err := item.dial(ctx, probeTimeout)
+	if err != nil {
+		return err
+	}
+
+	client := paho.NewClient(paho.ClientConfig{Conn: conn})
+	_, err = client.Connect(ctx, &paho.Connect{
+		ClientID:     clientID,
+		KeepAlive:    30,
+		CleanStart:   true,
+		Username:     item.config.Username,
+		UsernameFlag: item.config.Username != "",
+		Password:     []byte(item.config.Password.Value()),
+		PasswordFlag: item.config.Password.IsSet(),
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+}
+
+const (
+	probeTimeout = 5 * time.Second
+	maxBackoff   = 32 // Most times the failback interval is stretched after failing back did not last
+)
+
+// failback periodically checks whether the preferred broker is accepting connections again while connected to
+// another one. When it is, the connection is dropped so autopaho reconnects, starting with the preferred broker. If
+// the Responder ends up back on another broker, the interval is doubled each time, so a broker which accepts a
+// probe but not the real connection does not make it flap
+func (b *brokers) failback(ctx context.Context, interval time.Duration, clientID string) {
+
+	preferred := b.list[0]
+	backoff := 1
+	failedBack := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval * time.Duration(backoff)):
+		}
+
+		b.mutex.Lock()
+		current, conn := b.current, b.conn
+		b.mutex.Unlock()
+
+		if current == nil || current == preferred {
+			backoff, failedBack = 1, false
+			continue
+		}
+
+		if failedBack {
+			backoff = min(backoff*2, maxBackoff)
+			failedBack = false
+			logger.Warn("failing back did not last", "broker", preferred.config.GetServer(), "next", interval*time.Duration(backoff))
+			continue
+		}
+
+		err := preferred.probe(ctx, clientID)
+		if err != nil {
+			logger.Debug("preferred broker is still unavailable", "broker", preferred.config.GetServer(), "error", err)
+			continue
+		}
+
+		logger.Info("failing back", "from", current.config.GetServer(), "to", preferred.config.GetServer())
+		failedBack = true
+		conn.Close()
+	}
+}
@@ -0,0 +1,94 @@
+/* see:
+ *    https://github.com/eclipse/paho.golang/blob/v0.21.0/autopaho/examples/basics/basics.go
+ */
+
+package connection
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+)
+
+var logger = loggerlevel.Logger(loggerlevel.Mqtt)
+
+// NewConfig returns the autopaho configuration for a component which resumes its session from one run to the next,
+// under a stable client id. Only the Responder does, so the requests sent while it restarts are kept for it. The
+// caller adds the OnConnectionUp and OnPublishReceived callbacks
+func NewConfig(ctx context.Context, config *config.MqttConfig, component string) (*autopaho.ClientConfig, error) {
+
+	clientID, err := config.GetClientID(component)
+	if err != nil {
+		return nil, err
+	}
+	return newConfig(ctx, config, clientID, config.CleanStart, config.SessionExpiryInterval)
+}
+
+// NewTransientConfig returns the autopaho configuration for a component which does not need its session again, such
+// as the requesters. It connects under a client id unique to the run, with a clean session which ends with the
+// connection, so two runs at once cannot take over each other's connection or be sent each other's messages
+func NewTransientConfig(ctx context.Context, config *config.MqttConfig, component string) (*autopaho.ClientConfig, error) {
+
+	clientID, err := config.GetRunClientID(component)
+	if err != nil {
+		return nil, err
+	}
+	return newConfig(ctx, config, clientID, true, 0)
+}
+
+func newConfig(ctx context.Context, config *config.MqttConfig, clientID string, cleanStart bool, sessionExpiry uint32) (*autopaho.ClientConfig, error) {
+
+	b, err := newBrokers(config.GetBrokers())
+	if err != nil {
+		return nil, err
+	}
+
+	mqttConfig := autopaho.ClientConfig{
+		ServerUrls:                    b.urls(),
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: cleanStart,
+		SessionExpiryInterval:         sessionExpiry,
+		ConnectRetryDelay:             2 * time.Second,
+		ConnectTimeout:                5 * time.Second,
+		AttemptConnection:             b.attemptConnection,
+		ConnectPacketBuilder:          b.buildConnectPacket,
+		OnConnectError:                func(err error) { logger.Warn("could not connect to the broker", "error", err) },
+		ClientConfig: paho.ClientConfig{
+			OnClientError: func(err error) { logger.Warn("client error", "error", err) },
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				if d.Properties != nil {
+					logger.Warn("disconnected by the broker", "reason", d.Properties.ReasonString)
+				} else {
+					logger.Warn("disconnected by the broker", "code", d.ReasonCode)
+				}
+			},
+		},
+	}
+
+	mqttConfig.ClientConfig.ClientID = clientID
+
+	failback, err := config.GetFailback()
+	if err != nil {
+		return nil, err
+	}
+	if failback > 0 && len(b.list) > 1 {
+		go b.failback(ctx, failback, clientID+"-probe")
+	}
+
+	return &mqttConfig, nil
+}
+
+func parseServer(c *config.BrokerConfig) (*url.URL, error) {
+	switch c.GetScheme() {
+	case "mqtt", "mqtts", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("unexpected mqtt scheme: %s", c.Scheme)
+	}
+	return url.Parse(c.GetServer())
+}
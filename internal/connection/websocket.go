@@ -0,0 +1,105 @@
+package connection
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/gorilla/websocket"
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+// NewWebSocketConfig configures the websocket handshake for ws and wss connections, e.g. through a reverse proxy
+func NewWebSocketConfig(c *config.WebSocketConfig) (*autopaho.WebSocketConfig, error) {
+
+	proxy := http.ProxyFromEnvironment
+	if c.Proxy != "" {
+		proxyUrl, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse websocket proxy: %w", err)
+		}
+		proxy = http.ProxyURL(proxyUrl)
+	}
+
+	header := http.Header{}
+	for key, value := range c.Headers {
+		header.Set(key, value)
+	}
+
+	webSocketConfig := &autopaho.WebSocketConfig{
+		Dialer: func(url *url.URL, tlsCfg *tls.Config) *websocket.Dialer {
+			d := *websocket.DefaultDialer
+			d.TLSClientConfig = tlsCfg
+			d.Subprotocols = []string{"mqtt"}
+			d.Proxy = proxy
+			return &d
+		},
+		Header: func(url *url.URL, tlsCfg *tls.Config) http.Header {
+			return header.Clone()
+		},
+	}
+
+	return webSocketConfig, nil
+}
+
+// webSocketConn presents a websocket as the stream of bytes paho expects
+type webSocketConn struct {
+	*websocket.Conn
+	reader io.Reader
+	mutex  sync.Mutex
+}
+
+func dialWebSocket(ctx context.Context, cfg *autopaho.WebSocketConfig, tlsCfg *tls.Config, u *url.URL) (net.Conn, error) {
+	ws, _, err := cfg.Dialer(u, tlsCfg).DialContext(ctx, u.String(), cfg.Header(u, tlsCfg))
+	if err != nil {
+		return nil, fmt.Errorf("websocket connection failed: %w", err)
+	}
+	return &webSocketConn{Conn: ws}, nil
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -6,29 +6,139 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log/slog"
+	"time"
 
 	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-func Connect(dBConfig *config.DBConfig) (*sql.DB, error) {
+var logger = loggerlevel.Logger(loggerlevel.DB)
+
+// Connect opens the database and waits until it can be reached, retrying with backoff for up to the startup
+// timeout. A wrong password, or a database which does not exist, fails straight away
+func Connect(ctx context.Context, dBConfig *config.DBConfig) (*sql.DB, error) {
 
 	driverName := dBConfig.DriverName()
 	databaseName := dBConfig.Database
 
 	connectionString := dBConfig.ConnectionString(databaseName)
 
+	// The connection string holds the password, so it is never logged
 	db, err := sql.Open(driverName, connectionString)
 	if err != nil {
-		slog.Error(err.Error())
-		slog.Error(fmt.Sprintf("driverName: %s", driverName))
-		slog.Error(fmt.Sprintf("connectionString: %s", connectionString))
-		return nil, fmt.Errorf("could not connect to database")
+		logger.Error(fmt.Sprintf("driverName: %s, host: %s, port: %d, database: %s", driverName, dBConfig.Host, dBConfig.Port, databaseName))
+		return nil, fmt.Errorf("could not connect to database: %w", err)
+	}
+
+	err = configurePool(db, &dBConfig.Pool)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	startupTimeout, err := dBConfig.GetStartupTimeout()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = ping(ctx, db, startupTimeout)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not connect to database %s on %s:%d: %w", databaseName, dBConfig.Host, dBConfig.Port, err)
+	}
+
+	logger.Info(fmt.Sprintf("connected to database %s on %s:%d", databaseName, dBConfig.Host, dBConfig.Port))
+	return db, nil
+}
+
+func configurePool(db *sql.DB, c *config.DBPoolConfig) error {
+
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+
+	if c.ConnMaxLifetime != "" {
+		lifetime, err := time.ParseDuration(c.ConnMaxLifetime)
+		if err != nil {
+			return err
+		}
+		db.SetConnMaxLifetime(lifetime)
 	}
 
-	return db, err
+	if c.ConnMaxIdleTime != "" {
+		idleTime, err := time.ParseDuration(c.ConnMaxIdleTime)
+		if err != nil {
+			return err
+		}
+		db.SetConnMaxIdleTime(idleTime)
+	}
+
+	return nil
+}
+
+// ping tries the database until it answers, waiting twice as long after each failure, up to 10s
+func ping(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+	backoff := 500 * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if permanent(err) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		logger.Info(fmt.Sprintf("database not reachable (attempt %d), retrying in %s: %s", attempt, backoff, err))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, 10*time.Second)
+	}
+}
+
+// permanent reports whether retrying cannot help, because the credentials were refused or the database does
+// not exist
+func permanent(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code.Class() {
+	case "28", "3D": // invalid authorization, invalid catalog name
+		return true
+	}
+	return false
+}
+
+// Stats reports the state of the connection pool
+func Stats(db *sql.DB) map[string]interface{} {
+	s := db.Stats()
+	return map[string]interface{}{
+		"maxOpenConnections": s.MaxOpenConnections,
+		"openConnections":    s.OpenConnections,
+		"inUse":              s.InUse,
+		"idle":               s.Idle,
+		"waitCount":          s.WaitCount,
+		"waitDuration":       s.WaitDuration.String(),
+		"maxIdleClosed":      s.MaxIdleClosed,
+		"maxIdleTimeClosed":  s.MaxIdleTimeClosed,
+		"maxLifetimeClosed":  s.MaxLifetimeClosed,
+	}
 }
@@ -0,0 +1,123 @@
+package deadletter
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/encryption"
+	"github.com/rsmaxwell/diaries/internal/signing"
+)
+
+type Reason string
+
+const (
+	NoProperties         Reason = "no-properties"
+	NoCorrelationData    Reason = "no-correlation-data"
+	NoResponseTopic      Reason = "no-response-topic"
+	InvalidResponseTopic Reason = "invalid-response-topic"
+	DecryptFailed        Reason = "decrypt-failed"
+	HandlerFailed        Reason = "handler-failed"
+	MarshalFailed        Reason = "marshal-failed"
+	EncryptFailed        Reason = "encrypt-failed"
+	PublishFailed        Reason = "publish-failed"
+)
+
+// keptProperties are the only user properties a dead letter keeps. The bearer token and the signature are left out,
+// as dead letters are retained on the broker and a token could be replayed by anyone who can read them
+var keptProperties = map[string]bool{
+	"clientId":                   true,
+	"priority":                   true,
+	encryption.AlgorithmProperty: true,
+	encryption.KeyIDProperty:     true,
+}
+
+// credentialProperties are the user properties which show the request was authenticated or signed
+var credentialProperties = map[string]bool{
+	"authorization":           true,
+	signing.SignatureProperty: true,
+}
+
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// DeadLetter records a request which the Responder could not answer, together with
+// everything needed to inspect it and to replay it later
+type DeadLetter struct {
+	ID                 string         `json:"id"`
+	Reason             Reason         `json:"reason"`
+	Message            string         `json:"message"`
+	Timestamp          time.Time      `json:"timestamp"`
+	Topic              string         `json:"topic"`
+	ResponseTopic      string         `json:"responseTopic,omitempty"`
+	CorrelationData    []byte         `json:"correlationData,omitempty"`
+	ContentType        string         `json:"contentType,omitempty"`
+	UserProperties     []UserProperty `json:"userProperties,omitempty"`
+	Payload            []byte         `json:"payload"`
+	PayloadOmitted     bool           `json:"payloadOmitted,omitempty"`     // The payload held credentials, so was not kept
+	CredentialsOmitted bool           `json:"credentialsOmitted,omitempty"` // The token or signature was left out, so it cannot be replayed
+}
+
+// New makes the dead letter for a request. The payload is only kept if keepPayload is set
+func New(packet *paho.Publish, reason Reason, message string, keepPayload bool) *DeadLetter {
+
+	now := time.Now().UTC()
+
+	d := new(DeadLetter)
+	d.ID = fmt.Sprintf("%d-%08x", now.UnixNano(), rand.Uint32()) // The suffix keeps dead letters made at the same time apart
+	d.Reason = reason
+	d.Message = message
+	d.Timestamp = now
+	d.Topic = packet.Topic
+	if keepPayload {
+		d.Payload = packet.Payload
+	} else {
+		d.PayloadOmitted = true
+	}
+
+	if packet.Properties != nil {
+		d.ResponseTopic = packet.Properties.ResponseTopic
+		d.CorrelationData = packet.Properties.CorrelationData
+		d.ContentType = packet.Properties.ContentType
+		for _, p := range packet.Properties.User {
+			if credentialProperties[p.Key] {
+				d.CredentialsOmitted = true
+			}
+			if !keptProperties[p.Key] {
+				continue
+			}
+			d.UserProperties = append(d.UserProperties, UserProperty{Key: p.Key, Value: p.Value})
+		}
+	}
+
+	return d
+}
+
+// GetTopic returns the topic the dead letter is retained on, below the configured base topic
+func (d *DeadLetter) GetTopic(base string) string {
+	return fmt.Sprintf("%s/%s", base, d.ID)
+}
+
+// Original rebuilds the request as it was originally published, ready to be replayed. It has no token or
+// signature, so only requests which had neither can be replayed
+func (d *DeadLetter) Original() *paho.Publish {
+
+	p := &paho.Publish{
+		Topic:   d.Topic,
+		Payload: d.Payload,
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   d.ResponseTopic,
+			CorrelationData: d.CorrelationData,
+			ContentType:     d.ContentType,
+		},
+	}
+
+	for _, u := range d.UserProperties {
+		p.Properties.User.Add(u.Key, u.Value)
+	}
+
+	return p
+}
@@ -0,0 +1,153 @@
+package diaries
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/authz"
+)
+
+var (
+	// ErrForbidden is returned both when the diary does not exist and when it has not been shared with the caller,
+	// so that a caller cannot discover which diaries exist
+	ErrForbidden = errors.New("diary has not been shared with you")
+	ErrNotFound  = errors.New("not found")
+)
+
+// The access a user has been given to a diary. Write implies read
+const (
+	Read  = "read"
+	Write = "write"
+	None  = "none"
+)
+
+type Diary struct {
+	ID     int64  `json:"id"`
+	Title  string `json:"title"`
+	Access string `json:"access"`
+}
+
+type Page struct {
+	ID     int64  `json:"id"`
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+}
+
+// Store keeps the diaries, their pages and who they are shared with. Every query made on behalf of a caller is
+// restricted to the diaries the caller may see. Admins see everything
+type Store struct {
+	repo Repository
+}
+
+func NewStore(repo Repository) *Store {
+	s := new(Store)
+	s.repo = repo
+	return s
+}
+
+func isAdmin(principal *auth.Principal) bool {
+	return principal != nil && principal.Role == authz.Admin
+}
+
+func subject(principal *auth.Principal) string {
+	if principal == nil {
+		return ""
+	}
+	return principal.Subject
+}
+
+// List returns the diaries the caller may see
+func (s *Store) List(principal *auth.Principal) ([]Diary, error) {
+	if isAdmin(principal) {
+		return s.repo.ListAll()
+	}
+	return s.repo.ListShared(subject(principal))
+}
+
+// Check returns ErrForbidden unless the caller has at least the given access to the diary
+func (s *Store) Check(principal *auth.Principal, diaryID int64, access string) error {
+
+	granted := None
+	if isAdmin(principal) {
+		exists, err := s.repo.Exists(diaryID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			granted = Write
+		}
+	} else {
+		var err error
+		granted, err = s.repo.Access(diaryID, subject(principal))
+		if err != nil {
+			return err
+		}
+	}
+
+	if granted == None {
+		return ErrForbidden
+	}
+	if access == Write && granted != Write {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Pages returns the pages of a diary the caller may read
+func (s *Store) Pages(principal *auth.Principal, diaryID int64) ([]Page, error) {
+
+	err := s.Check(principal, diaryID, Read)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.Pages(diaryID)
+}
+
+// AddDiary adds an empty diary, which its creator may write to. Admins may write to every diary already
+func (s *Store) AddDiary(principal *auth.Principal, title string) (int64, error) {
+
+	if title == "" {
+		return 0, fmt.Errorf("the title must not be empty")
+	}
+
+	owner := subject(principal)
+	if isAdmin(principal) {
+		owner = ""
+	}
+	return s.repo.CreateDiary(title, owner)
+}
+
+// AddPage adds a page to the end of a diary the caller may write to
+func (s *Store) AddPage(principal *auth.Principal, diaryID int64, title string) (*Page, error) {
+
+	err := s.Check(principal, diaryID, Write)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.CreatePage(diaryID, title)
+}
+
+// Share gives the user read or write access to a diary, or takes it away with None
+func (s *Store) Share(diaryID int64, username string, access string) error {
+
+	switch access {
+	case Read, Write, None:
+	default:
+		return fmt.Errorf("unexpected access '%s': expected %s, %s or %s", access, Read, Write, None)
+	}
+
+	exists, err := s.repo.Exists(diaryID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("diary %d: %w", diaryID, ErrNotFound)
+	}
+
+	err = s.repo.SetAccess(diaryID, username, access)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("user '%s': %w", username, ErrNotFound)
+	}
+	return err
+}
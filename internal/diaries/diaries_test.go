@@ -0,0 +1,65 @@
+package diaries
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rsmaxwell/diaries/internal/auth"
+	"github.com/rsmaxwell/diaries/internal/authz"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+func TestAddPage(t *testing.T) {
+
+	people := users.NewMemory()
+	for _, username := range []string{"writer", "reader", "stranger"} {
+		if err := people.CreateUser(&users.Record{User: users.User{Username: username, Role: authz.Transcriber}, PasswordHash: "hash"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := NewMemory(people)
+	s := NewStore(repo)
+
+	diary, err := s.AddDiary(&auth.Principal{Subject: "writer", Role: authz.Editor}, "1900")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Share(diary, "reader", Read); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		diary     int64
+		wantErr   error
+	}{
+		{name: "creator", principal: &auth.Principal{Subject: "writer", Role: authz.Transcriber}},
+		{name: "admin", principal: &auth.Principal{Subject: "someone", Role: authz.Admin}},
+		{name: "read access", principal: &auth.Principal{Subject: "reader", Role: authz.Transcriber}, wantErr: ErrForbidden},
+		{name: "not shared", principal: &auth.Principal{Subject: "stranger", Role: authz.Transcriber}, wantErr: ErrForbidden},
+		{name: "no such diary", principal: &auth.Principal{Subject: "writer", Role: authz.Transcriber}, diary: 999, wantErr: ErrForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := diary
+			if tt.diary != 0 {
+				id = tt.diary
+			}
+			_, err := s.AddPage(tt.principal, id, "page")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("AddPage: %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	pages, err := s.Pages(&auth.Principal{Subject: "reader", Role: authz.Reader}, diary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 || pages[0].Number != 1 || pages[1].Number != 2 {
+		t.Errorf("Pages = %v, want pages 1 and 2", pages)
+	}
+}
@@ -0,0 +1,189 @@
+package diaries
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+type memoryDiary struct {
+	title  string
+	pages  []Page
+	access map[int64]string // By user id, so a user who is deleted and created again does not get it back
+}
+
+// Memory keeps the diaries in memory, for demos and tests. Usernames are looked up in the users' repository
+type Memory struct {
+	mutex     sync.Mutex
+	people    users.Repository
+	nextDiary int64
+	nextPage  int64
+	diaries   map[int64]*memoryDiary
+}
+
+func NewMemory(people users.Repository) *Memory {
+	m := new(Memory)
+	m.people = people
+	m.diaries = map[int64]*memoryDiary{}
+	return m
+}
+
+// AddDiary adds an empty diary, returning its id, for seeding the memory repository
+func (m *Memory) AddDiary(title string) int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.nextDiary++
+	m.diaries[m.nextDiary] = &memoryDiary{title: title, access: map[int64]string{}}
+	return m.nextDiary
+}
+
+// AddPage adds a page to the end of the diary
+func (m *Memory) AddPage(diaryID int64, title string) error {
+	_, err := m.CreatePage(diaryID, title)
+	return err
+}
+
+func (m *Memory) CreateDiary(title string, username string) (int64, error) {
+
+	userID, err := m.userID(username)
+	if err != nil {
+		return 0, err
+	}
+
+	id := m.AddDiary(title)
+	if userID != 0 {
+		m.mutex.Lock()
+		m.diaries[id].access[userID] = Write
+		m.mutex.Unlock()
+	}
+	return id, nil
+}
+
+func (m *Memory) CreatePage(diaryID int64, title string) (*Page, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	diary, ok := m.diaries[diaryID]
+	if !ok {
+		return nil, fmt.Errorf("diary %d: %w", diaryID, ErrNotFound)
+	}
+	m.nextPage++
+	page := Page{ID: m.nextPage, Number: len(diary.pages) + 1, Title: title}
+	diary.pages = append(diary.pages, page)
+	return &page, nil
+}
+
+// userID returns 0 if there is no such user
+func (m *Memory) userID(username string) (int64, error) {
+	record, err := m.people.GetUser(username)
+	if errors.Is(err, users.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return record.ID, nil
+}
+
+// list must be called with the mutex held
+func (m *Memory) list(access func(d *memoryDiary) string) []Diary {
+	list := []Diary{}
+	for id, d := range m.diaries {
+		if a := access(d); a != None {
+			list = append(list, Diary{ID: id, Title: d.title, Access: a})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (m *Memory) ListAll() ([]Diary, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.list(func(*memoryDiary) string { return Write }), nil
+}
+
+func (m *Memory) ListShared(username string) ([]Diary, error) {
+
+	userID, err := m.userID(username)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.list(func(d *memoryDiary) string {
+		if a, ok := d.access[userID]; ok {
+			return a
+		}
+		return None
+	}), nil
+}
+
+func (m *Memory) Exists(diaryID int64) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.diaries[diaryID]
+	return ok, nil
+}
+
+func (m *Memory) Access(diaryID int64, username string) (string, error) {
+
+	userID, err := m.userID(username)
+	if err != nil {
+		return "", err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if diary, ok := m.diaries[diaryID]; ok {
+		if a, ok := diary.access[userID]; ok {
+			return a, nil
+		}
+	}
+	return None, nil
+}
+
+func (m *Memory) Pages(diaryID int64) ([]Page, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	list := []Page{}
+	if diary, ok := m.diaries[diaryID]; ok {
+		list = append(list, diary.pages...)
+	}
+	return list, nil
+}
+
+func (m *Memory) SetAccess(diaryID int64, username string, access string) error {
+
+	userID, err := m.userID(username)
+	if err != nil {
+		return err
+	}
+	if userID == 0 {
+		return ErrNotFound
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	diary, ok := m.diaries[diaryID]
+	if !ok {
+		return nil
+	}
+	if access == None {
+		delete(diary.access, userID)
+	} else {
+		diary.access[userID] = access
+	}
+	return nil
+}
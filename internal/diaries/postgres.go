@@ -0,0 +1,158 @@
+package diaries
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+type postgres struct {
+	db *sql.DB
+}
+
+// NewPostgres keeps the diaries in the diaries, pages and diary_access tables
+func NewPostgres(db *sql.DB) Repository {
+	return &postgres{db: db}
+}
+
+func (p *postgres) ListAll() ([]Diary, error) {
+	return p.diaries(`SELECT id, title, 'write' FROM diaries ORDER BY id`)
+}
+
+func (p *postgres) ListShared(username string) ([]Diary, error) {
+	return p.diaries(`
+		SELECT d.id, d.title, a.access FROM diaries d
+		JOIN diary_access a ON a.diary_id = d.id
+		JOIN users u ON u.id = a.user_id
+		WHERE u.username = $1
+		ORDER BY d.id`, username)
+}
+
+func (p *postgres) diaries(query string, args ...any) ([]Diary, error) {
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Diary{}
+	for rows.Next() {
+		var diary Diary
+		if err := rows.Scan(&diary.ID, &diary.Title, &diary.Access); err != nil {
+			return nil, err
+		}
+		list = append(list, diary)
+	}
+	return list, rows.Err()
+}
+
+func (p *postgres) Exists(diaryID int64) (bool, error) {
+	var exists bool
+	err := p.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM diaries WHERE id = $1)`, diaryID).Scan(&exists)
+	return exists, err
+}
+
+func (p *postgres) Access(diaryID int64, username string) (string, error) {
+	var granted string
+	err := p.db.QueryRow(`
+		SELECT a.access FROM diary_access a
+		JOIN users u ON u.id = a.user_id
+		WHERE a.diary_id = $1 AND u.username = $2`, diaryID, username).Scan(&granted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return None, nil
+	}
+	return granted, err
+}
+
+func (p *postgres) Pages(diaryID int64) ([]Page, error) {
+
+	rows, err := p.db.Query(`SELECT id, number, title FROM pages WHERE diary_id = $1 ORDER BY number`, diaryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Page{}
+	for rows.Next() {
+		var page Page
+		if err := rows.Scan(&page.ID, &page.Number, &page.Title); err != nil {
+			return nil, err
+		}
+		list = append(list, page)
+	}
+	return list, rows.Err()
+}
+
+func (p *postgres) CreateDiary(title string, username string) (int64, error) {
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(`INSERT INTO diaries (title) VALUES ($1) RETURNING id`, title).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	if username != "" {
+		_, err = tx.Exec(`INSERT INTO diary_access (diary_id, user_id, access) SELECT $1, id, 'write' FROM users WHERE username = $2`, id, username)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// CreatePage locks the diary while the page is numbered, so pages added at the same time get different numbers
+func (p *postgres) CreatePage(diaryID int64, title string) (*Page, error) {
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(`SELECT id FROM diaries WHERE id = $1 FOR UPDATE`, diaryID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("diary %d: %w", diaryID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var page Page
+	err = tx.QueryRow(`
+		INSERT INTO pages (diary_id, number, title)
+		SELECT $1, COALESCE(MAX(number), 0) + 1, $2 FROM pages WHERE diary_id = $1
+		RETURNING id, number, title`, diaryID, title).Scan(&page.ID, &page.Number, &page.Title)
+	if err != nil {
+		return nil, err
+	}
+	return &page, tx.Commit()
+}
+
+func (p *postgres) SetAccess(diaryID int64, username string, access string) error {
+
+	var userID int64
+	err := p.db.QueryRow(`SELECT id FROM users WHERE username = $1`, username).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if access == None {
+		_, err = p.db.Exec(`DELETE FROM diary_access WHERE diary_id = $1 AND user_id = $2`, diaryID, userID)
+		return err
+	}
+	_, err = p.db.Exec(`
+		INSERT INTO diary_access (diary_id, user_id, access) VALUES ($1, $2, $3)
+		ON CONFLICT (diary_id, user_id) DO UPDATE SET access = EXCLUDED.access`, diaryID, userID, access)
+	return err
+}
@@ -0,0 +1,19 @@
+package diaries
+
+// Repository keeps the diaries, their pages and who they are shared with. The Store decides who may see what; a
+// Repository only stores and finds
+type Repository interface {
+	ListAll() ([]Diary, error)                   // Every diary, with write access, in order of id
+	ListShared(username string) ([]Diary, error) // The diaries shared with the user, with their access, in order of id
+	Exists(diaryID int64) (bool, error)
+	Access(diaryID int64, username string) (string, error) // None if the diary has not been shared with the user
+	Pages(diaryID int64) ([]Page, error)                   // In order of page number
+
+	// CreateDiary adds an empty diary and gives the user write access to it, unless the username is empty
+	CreateDiary(title string, username string) (int64, error)
+	CreatePage(diaryID int64, title string) (*Page, error) // Adds the page after the last. ErrNotFound if there is no such diary
+
+	// SetAccess gives the user access to the diary, replacing any they had, or takes it away with None.
+	// ErrNotFound if there is no such user
+	SetAccess(diaryID int64, username string, access string) error
+}
@@ -0,0 +1,252 @@
+package dynsec
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+)
+
+var logger = loggerlevel.Logger(loggerlevel.Mqtt)
+
+// Command is one command of the dynamic security plugin. Only the fields the command needs are sent
+type Command struct {
+	Command         string `json:"command"`
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	Rolename        string `json:"rolename,omitempty"`
+	Groupname       string `json:"groupname,omitempty"`
+	Textname        string `json:"textname,omitempty"`
+	ACLType         string `json:"acltype,omitempty"`
+	Topic           string `json:"topic,omitempty"`
+	Allow           *bool  `json:"allow,omitempty"`
+	Roles           []Role `json:"roles,omitempty"`
+	ACLs            []ACL  `json:"acls,omitempty"`
+	CorrelationData string `json:"correlationData,omitempty"`
+}
+
+type Role struct {
+	Rolename string `json:"rolename"`
+}
+
+// Group is a group of clients, which gives each of them the group's roles
+type Group struct {
+	Groupname string `json:"groupname"`
+}
+
+// ClientInfo is a client as the plugin describes it
+type ClientInfo struct {
+	Username string  `json:"username"`
+	Roles    []Role  `json:"roles"`
+	Groups   []Group `json:"groups"`
+	Disabled bool    `json:"disabled"`
+}
+
+type ACL struct {
+	ACLType string `json:"acltype"`
+	Topic   string `json:"topic"`
+	Allow   bool   `json:"allow"`
+}
+
+type Request struct {
+	Commands []Command `json:"commands"`
+}
+
+type Result struct {
+	Command         string          `json:"command"`
+	Error           string          `json:"error,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	CorrelationData string          `json:"correlationData,omitempty"`
+}
+
+type Response struct {
+	Responses []Result `json:"responses"`
+}
+
+// Publisher is the part of the broker connection the client needs
+type Publisher interface {
+	Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error)
+}
+
+// Client sends commands to the dynamic security plugin and waits for its answers, which arrive on the response
+// topic and are passed to Deliver. A nil Client does nothing, for when dynamic security is not enabled
+type Client struct {
+	topic         string
+	responseTopic string
+	rolePrefix    string
+	timeout       time.Duration
+
+	mu        sync.Mutex
+	publisher Publisher
+	pending   map[string]chan *Response
+}
+
+// New returns nil when dynamic security is not enabled
+func New(c *config.DynamicSecurityConfig) (*Client, error) {
+
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	timeout, err := c.GetTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(Client)
+	d.topic = c.GetTopic()
+	d.responseTopic = c.GetResponseTopic()
+	d.rolePrefix = c.GetRolePrefix()
+	d.timeout = timeout
+	d.pending = make(map[string]chan *Response)
+	return d, nil
+}
+
+// ResponseTopic is the topic to subscribe to for the answers
+func (d *Client) ResponseTopic() string {
+	if d == nil {
+		return ""
+	}
+	return d.responseTopic
+}
+
+// SetPublisher gives the client the connection to send commands on, once it is up
+func (d *Client) SetPublisher(publisher Publisher) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.publisher = publisher
+	d.mu.Unlock()
+}
+
+// Deliver passes an answer from the plugin to the commands waiting for it
+func (d *Client) Deliver(packet *paho.Publish) {
+
+	if d == nil {
+		return
+	}
+
+	var response Response
+	if err := json.Unmarshal(packet.Payload, &response); err != nil {
+		logger.Warn("could not decode dynamic security response", "error", err)
+		return
+	}
+	if len(response.Responses) == 0 {
+		return
+	}
+
+	id := response.Responses[0].CorrelationData
+
+	d.mu.Lock()
+	ch := d.pending[id]
+	delete(d.pending, id)
+	d.mu.Unlock()
+
+	if ch != nil {
+		ch <- &response
+	}
+}
+
+// Execute sends the commands together and returns the error of the first which failed
+func (d *Client) Execute(ctx context.Context, commands ...Command) error {
+	_, err := d.execute(ctx, func(string) bool { return false }, commands...)
+	return err
+}
+
+// execute sends the commands, ignoring the errors which the ignore function accepts
+func (d *Client) execute(ctx context.Context, ignore func(string) bool, commands ...Command) (*Response, error) {
+
+	d.mu.Lock()
+	publisher := d.publisher
+	d.mu.Unlock()
+	if publisher == nil {
+		return nil, fmt.Errorf("not connected to the broker")
+	}
+
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(random)
+
+	for i := range commands {
+		commands[i].CorrelationData = id
+	}
+
+	payload, err := json.Marshal(Request{Commands: commands})
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *Response, 1)
+	d.mu.Lock()
+	d.pending[id] = ch
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, id)
+		d.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	_, err = publisher.Publish(ctx, &paho.Publish{
+		QoS:     1,
+		Topic:   d.topic,
+		Payload: payload,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not send dynamic security commands: %w", err)
+	}
+
+	var response *Response
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no answer from dynamic security: %w", ctx.Err())
+	case response = <-ch:
+	}
+
+	for _, result := range response.Responses {
+		if result.Error != "" && !ignore(result.Error) {
+			return response, fmt.Errorf("dynamic security %s: %s", result.Command, result.Error)
+		}
+	}
+	return response, nil
+}
+
+// query sends one command and decodes the data of its answer. It reports false if the plugin did not find what was
+// asked for
+func (d *Client) query(ctx context.Context, command Command, data any) (bool, error) {
+
+	response, err := d.execute(ctx, notFound, command)
+	if err != nil {
+		return false, err
+	}
+	if len(response.Responses) == 0 {
+		return false, fmt.Errorf("dynamic security %s: no answer", command.Command)
+	}
+
+	result := response.Responses[0]
+	if result.Error != "" {
+		return false, nil
+	}
+	return true, json.Unmarshal(result.Data, data)
+}
+
+func alreadyExists(message string) bool {
+	return strings.Contains(strings.ToLower(message), "already")
+}
+
+func notFound(message string) bool {
+	return strings.Contains(strings.ToLower(message), "not found")
+}
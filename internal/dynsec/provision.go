@@ -0,0 +1,271 @@
+package dynsec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rsmaxwell/diaries/internal/mosquitto"
+)
+
+// The broker ACL types which give read and write access
+var aclTypes = map[string][]string{
+	"read":      {"subscribePattern", "publishClientReceive"},
+	"write":     {"publishClientSend"},
+	"readwrite": {"subscribePattern", "publishClientReceive", "publishClientSend"},
+}
+
+func (d *Client) rolename(role string) string {
+	return d.rolePrefix + role
+}
+
+// EnsureRoles gives each diaries role a broker role with exactly the topics of the generated ACL file. ACLs which the
+// role should not have, such as ones added by hand or left from an older layout of the topics, are removed
+func (d *Client) EnsureRoles(ctx context.Context, roles []string, topics *mosquitto.Topics) error {
+
+	if d == nil {
+		return nil
+	}
+
+	for _, role := range roles {
+
+		rolename := d.rolename(role)
+		_, err := d.execute(ctx, alreadyExists, Command{Command: "createRole", Rolename: rolename})
+		if err != nil {
+			return err
+		}
+
+		var data struct {
+			Role struct {
+				ACLs []ACL `json:"acls"`
+			} `json:"role"`
+		}
+		found, err := d.query(ctx, Command{Command: "getRole", Rolename: rolename}, &data)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("broker role '%s' was not created", rolename)
+		}
+
+		wanted := map[ACL]bool{}
+		var commands []Command
+		for _, rule := range topics.Rules(role) {
+			for _, aclType := range aclTypes[rule.Access] {
+				wanted[ACL{ACLType: aclType, Topic: rule.Topic, Allow: true}] = true
+			}
+		}
+
+		existing := map[ACL]bool{}
+		for _, acl := range data.Role.ACLs {
+			existing[acl] = true
+			if !wanted[acl] {
+				commands = append(commands, Command{Command: "removeRoleACL", Rolename: rolename, ACLType: acl.ACLType, Topic: acl.Topic})
+			}
+		}
+
+		for _, rule := range topics.Rules(role) {
+			for _, aclType := range aclTypes[rule.Access] {
+				if !existing[ACL{ACLType: aclType, Topic: rule.Topic, Allow: true}] {
+					allow := true
+					commands = append(commands, Command{Command: "addRoleACL", Rolename: rolename, ACLType: aclType, Topic: rule.Topic, Allow: &allow})
+				}
+			}
+		}
+
+		if len(commands) > 0 {
+			if err := d.Execute(ctx, commands...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ListClients returns the usernames of all the broker's clients, including those which are not for diaries users
+func (d *Client) ListClients(ctx context.Context) ([]string, error) {
+
+	if d == nil {
+		return nil, nil
+	}
+
+	var data struct {
+		Clients []string `json:"clients"`
+	}
+	if _, err := d.query(ctx, Command{Command: "listClients"}, &data); err != nil {
+		return nil, err
+	}
+	return data.Clients, nil
+}
+
+// GetClients returns the clients with the given usernames, asking for them all at once. Clients which do not exist
+// are left out
+func (d *Client) GetClients(ctx context.Context, usernames []string) (map[string]*ClientInfo, error) {
+
+	clients := map[string]*ClientInfo{}
+	if d == nil || len(usernames) == 0 {
+		return clients, nil
+	}
+
+	commands := make([]Command, len(usernames))
+	for i, username := range usernames {
+		commands[i] = Command{Command: "getClient", Username: username}
+	}
+
+	response, err := d.execute(ctx, notFound, commands...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range response.Responses {
+		if result.Error != "" {
+			continue
+		}
+		var data struct {
+			Client ClientInfo `json:"client"`
+		}
+		if err := json.Unmarshal(result.Data, &data); err != nil {
+			return nil, err
+		}
+		clients[data.Client.Username] = &data.Client
+	}
+	return clients, nil
+}
+
+// Managed reports whether the client has one of the diaries roles, so it was made for a diaries user
+func (d *Client) Managed(client *ClientInfo) bool {
+	if d == nil {
+		return false
+	}
+	for _, role := range client.Roles {
+		if strings.HasPrefix(role.Rolename, d.rolePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateClient creates the broker client for a new user
+func (d *Client) CreateClient(ctx context.Context, username string, password string, role string) error {
+	if d == nil {
+		return nil
+	}
+	return d.Execute(ctx, Command{Command: "createClient", Username: username, Password: password, Roles: []Role{{Rolename: d.rolename(role)}}})
+}
+
+func (d *Client) SetPassword(ctx context.Context, username string, password string) error {
+	if d == nil {
+		return nil
+	}
+	return d.Execute(ctx, Command{Command: "setClientPassword", Username: username, Password: password})
+}
+
+// roleCommands are the commands which make the broker role of the user's role the client's only role, none if it
+// already is. Any other roles are removed, and the client is taken out of any groups, since they could give it more
+func (d *Client) roleCommands(client *ClientInfo, role string) []Command {
+
+	rolename := d.rolename(role)
+	var commands []Command
+	has := false
+	for _, r := range client.Roles {
+		if r.Rolename == rolename {
+			has = true
+			continue
+		}
+		commands = append(commands, Command{Command: "removeClientRole", Username: client.Username, Rolename: r.Rolename})
+	}
+	for _, g := range client.Groups {
+		commands = append(commands, Command{Command: "removeGroupClient", Username: client.Username, Groupname: g.Groupname})
+	}
+	if !has {
+		commands = append(commands, Command{Command: "addClientRole", Username: client.Username, Rolename: rolename})
+	}
+	return commands
+}
+
+// Disable disconnects the client and refuses its connections until it is enabled
+func (d *Client) Disable(ctx context.Context, username string) error {
+	if d == nil {
+		return nil
+	}
+	return d.Execute(ctx, Command{Command: "disableClient", Username: username})
+}
+
+func (d *Client) Enable(ctx context.Context, username string) error {
+	if d == nil {
+		return nil
+	}
+	return d.Execute(ctx, Command{Command: "enableClient", Username: username})
+}
+
+// Delete removes the client. A client which does not exist is not an error
+func (d *Client) Delete(ctx context.Context, username string) error {
+	if d == nil {
+		return nil
+	}
+	_, err := d.execute(ctx, notFound, Command{Command: "deleteClient", Username: username})
+	return err
+}
+
+// Batch collects changes to many clients, to send together in one round trip. A nil Batch does nothing, like the
+// nil Client it comes from
+type Batch struct {
+	d        *Client
+	commands []Command
+}
+
+func (d *Client) NewBatch() *Batch {
+	if d == nil {
+		return nil
+	}
+	return &Batch{d: d}
+}
+
+// SetRole makes the broker role of the user's role the client's only role
+func (b *Batch) SetRole(client *ClientInfo, role string) {
+	if b == nil {
+		return
+	}
+	b.commands = append(b.commands, b.d.roleCommands(client, role)...)
+}
+
+func (b *Batch) Disable(username string) {
+	if b == nil {
+		return
+	}
+	b.commands = append(b.commands, Command{Command: "disableClient", Username: username})
+}
+
+func (b *Batch) Enable(username string) {
+	if b == nil {
+		return
+	}
+	b.commands = append(b.commands, Command{Command: "enableClient", Username: username})
+}
+
+func (b *Batch) Delete(username string) {
+	if b == nil {
+		return
+	}
+	b.commands = append(b.commands, Command{Command: "deleteClient", Username: username})
+}
+
+// Len is the number of commands in the batch
+func (b *Batch) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.commands)
+}
+
+// Execute sends the commands, if there are any. The plugin carries out every command, and the error is that of the
+// first which failed, other than for a client which is already gone
+func (b *Batch) Execute(ctx context.Context) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	_, err := b.d.execute(ctx, notFound, b.commands...)
+	return err
+}
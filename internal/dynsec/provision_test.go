@@ -0,0 +1,112 @@
+package dynsec
+
+import (
+	"context"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/mosquitto"
+)
+
+// standInBroker passes the commands straight to a stand-in, and counts the round trips
+type standInBroker struct {
+	standIn *StandIn
+	client  *Client
+	trips   int
+}
+
+func (b *standInBroker) Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	b.trips++
+	payload, err := b.standIn.Handle(p.Payload)
+	if err != nil {
+		return nil, err
+	}
+	b.client.Deliver(&paho.Publish{Topic: b.client.ResponseTopic(), Payload: payload})
+	return &paho.PublishResponse{}, nil
+}
+
+func newStandInClient(t *testing.T) (*Client, *standInBroker) {
+	t.Helper()
+
+	client, err := New(&config.DynamicSecurityConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &standInBroker{standIn: NewStandIn(), client: client}
+	client.SetPublisher(broker)
+
+	topics := &mosquitto.Topics{Request: "request", Response: "response/%u/+", Status: "status/+", DeadLetter: "deadletter/#"}
+	if err := client.EnsureRoles(context.Background(), []string{"reader", "editor"}, topics); err != nil {
+		t.Fatal(err)
+	}
+	return client, broker
+}
+
+func TestBatch(t *testing.T) {
+
+	ctx := context.Background()
+	client, broker := newStandInClient(t)
+
+	for username, role := range map[string]string{"alice": "reader", "bob": "editor"} {
+		if err := client.CreateClient(ctx, username, "password", role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broker.trips = 0
+	clients, err := client.GetClients(ctx, []string{"alice", "bob", "nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broker.trips != 1 {
+		t.Errorf("GetClients took %d round trips, want 1", broker.trips)
+	}
+	if len(clients) != 2 || clients["alice"] == nil || clients["bob"] == nil {
+		t.Fatalf("GetClients = %v, want alice and bob", clients)
+	}
+
+	batch := client.NewBatch()
+
+	// A client which already has the right role needs no commands
+	batch.SetRole(clients["alice"], "reader")
+	if batch.Len() != 0 {
+		t.Errorf("SetRole of the role the client has added %d commands, want none", batch.Len())
+	}
+
+	batch.Disable("alice")
+	batch.SetRole(clients["bob"], "reader")
+	batch.Delete("nobody")
+
+	broker.trips = 0
+	if err := batch.Execute(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if broker.trips != 1 {
+		t.Errorf("Execute took %d round trips, want 1", broker.trips)
+	}
+
+	clients, err = client.GetClients(ctx, []string{"alice", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clients["alice"].Disabled {
+		t.Errorf("alice was not disabled")
+	}
+	if roles := clients["bob"].Roles; len(roles) != 1 || roles[0].Rolename != "diaries-reader" {
+		t.Errorf("bob has roles %v, want just diaries-reader", roles)
+	}
+}
+
+func TestNilBatch(t *testing.T) {
+
+	var client *Client
+	batch := client.NewBatch()
+	batch.Disable("alice")
+	if batch.Len() != 0 {
+		t.Errorf("Len = %d, want 0", batch.Len())
+	}
+	if err := batch.Execute(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
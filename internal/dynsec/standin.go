@@ -0,0 +1,191 @@
+package dynsec
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// StandIn answers dynamic security commands from memory, in the same JSON as the plugin, so provisioning can be
+// tried out without a broker which has the plugin loaded. Only the commands the diaries use are understood
+type StandIn struct {
+	mu      sync.Mutex
+	clients map[string]*StandInClient
+	roles   map[string]map[ACL]bool
+}
+
+type StandInClient struct {
+	Username string   `json:"username"`
+	Password string   `json:"-"`
+	Disabled bool     `json:"disabled,omitempty"`
+	Roles    []string `json:"roles"`
+}
+
+func NewStandIn() *StandIn {
+	s := new(StandIn)
+	s.clients = make(map[string]*StandInClient)
+	s.roles = make(map[string]map[ACL]bool)
+	return s
+}
+
+// Handle answers a request, as the plugin would on its response topic
+func (s *StandIn) Handle(payload []byte) ([]byte, error) {
+
+	var request Request
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var response Response
+	for _, command := range request.Commands {
+		result := Result{Command: command.Command, CorrelationData: command.CorrelationData}
+		data, err := s.apply(command)
+		if err != nil {
+			result.Error = err.Error()
+		} else if data != nil {
+			result.Data, err = json.Marshal(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		response.Responses = append(response.Responses, result)
+	}
+
+	return json.Marshal(response)
+}
+
+func (s *StandIn) apply(c Command) (any, error) {
+
+	client := s.clients[c.Username]
+
+	switch c.Command {
+	case "createClient":
+		if client != nil {
+			return nil, fmt.Errorf("Client already exists")
+		}
+		client = &StandInClient{Username: c.Username, Password: c.Password}
+		for _, role := range c.Roles {
+			if s.roles[role.Rolename] == nil {
+				return nil, fmt.Errorf("Role not found")
+			}
+			client.Roles = append(client.Roles, role.Rolename)
+		}
+		s.clients[c.Username] = client
+
+	case "deleteClient":
+		if client == nil {
+			return nil, fmt.Errorf("Client not found")
+		}
+		delete(s.clients, c.Username)
+
+	case "listClients":
+		usernames := []string{}
+		for username := range s.clients {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+		return map[string]any{"totalCount": len(usernames), "clients": usernames}, nil
+
+	case "getClient", "enableClient", "disableClient", "setClientPassword", "addClientRole", "removeClientRole":
+		if client == nil {
+			return nil, fmt.Errorf("Client not found")
+		}
+		switch c.Command {
+		case "getClient":
+			info := ClientInfo{Username: client.Username, Roles: []Role{}, Groups: []Group{}, Disabled: client.Disabled}
+			for _, role := range client.Roles {
+				info.Roles = append(info.Roles, Role{Rolename: role})
+			}
+			return map[string]any{"client": info}, nil
+		case "enableClient":
+			client.Disabled = false
+		case "disableClient":
+			client.Disabled = true
+		case "setClientPassword":
+			client.Password = c.Password
+		case "addClientRole":
+			if s.roles[c.Rolename] == nil {
+				return nil, fmt.Errorf("Role not found")
+			}
+			for _, role := range client.Roles {
+				if role == c.Rolename {
+					return nil, fmt.Errorf("Client is already in this role")
+				}
+			}
+			client.Roles = append(client.Roles, c.Rolename)
+		case "removeClientRole":
+			for i, role := range client.Roles {
+				if role == c.Rolename {
+					client.Roles = append(client.Roles[:i], client.Roles[i+1:]...)
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("Role not found")
+		}
+
+	case "createRole":
+		if s.roles[c.Rolename] != nil {
+			return nil, fmt.Errorf("Role already exists")
+		}
+		s.roles[c.Rolename] = make(map[ACL]bool)
+		for _, acl := range c.ACLs {
+			s.roles[c.Rolename][acl] = true
+		}
+
+	case "getRole", "addRoleACL", "removeRoleACL":
+		acls := s.roles[c.Rolename]
+		if acls == nil {
+			return nil, fmt.Errorf("Role not found")
+		}
+		switch c.Command {
+		case "getRole":
+			list := []ACL{}
+			for acl := range acls {
+				list = append(list, acl)
+			}
+			sort.Slice(list, func(i, j int) bool {
+				return list[i].Topic+list[i].ACLType < list[j].Topic+list[j].ACLType
+			})
+			return map[string]any{"role": map[string]any{"rolename": c.Rolename, "acls": list}}, nil
+		case "addRoleACL":
+			acl := ACL{ACLType: c.ACLType, Topic: c.Topic, Allow: c.Allow != nil && *c.Allow}
+			for existing := range acls {
+				if existing.ACLType == acl.ACLType && existing.Topic == acl.Topic {
+					return nil, fmt.Errorf("ACL with this topic already exists")
+				}
+			}
+			acls[acl] = true
+		case "removeRoleACL":
+			for existing := range acls {
+				if existing.ACLType == c.ACLType && existing.Topic == c.Topic {
+					delete(acls, existing)
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("ACL not found")
+		}
+
+	default:
+		return nil, fmt.Errorf("Unknown command")
+	}
+
+	return nil, nil
+}
+
+// State returns the clients, in order of username, for checking what has been provisioned
+func (s *StandIn) State() []StandInClient {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []StandInClient{}
+	for _, client := range s.clients {
+		list = append(list, *client)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
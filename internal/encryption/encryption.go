@@ -0,0 +1,183 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+// A256GCM is AES-256 in Galois/Counter Mode. The nonce is prepended to the ciphertext
+const A256GCM = "A256GCM"
+
+// The user properties of an encrypted payload
+const (
+	AlgorithmProperty = "encryption"
+	KeyIDProperty     = "keyId"
+)
+
+var ErrNotEncrypted = errors.New("payload is not encrypted")
+
+type key struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Keyring holds the keys payloads may be encrypted with. Listing an old key after a new one lets payloads
+// encrypted with either be decrypted while keys are rotated. A nil Keyring leaves payloads in the clear
+type Keyring struct {
+	keys     []*key
+	byID     map[string]*key
+	required bool
+}
+
+// NewKeyring returns nil when no keys are configured
+func NewKeyring(c *config.EncryptionConfig) (*Keyring, error) {
+
+	if len(c.Keys) == 0 {
+		if c.Required {
+			return nil, fmt.Errorf("encryption is required, but no keys are configured")
+		}
+		return nil, nil
+	}
+
+	k := new(Keyring)
+	k.byID = make(map[string]*key)
+	k.required = c.Required
+
+	for _, kc := range c.Keys {
+		key, err := newKey(&kc)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.byID[key.id]; ok {
+			return nil, fmt.Errorf("encryption key '%s' is listed more than once", key.id)
+		}
+		k.keys = append(k.keys, key)
+		k.byID[key.id] = key
+	}
+
+	return k, nil
+}
+
+func newKey(c *config.EncryptionKey) (*key, error) {
+
+	if c.ID == "" {
+		return nil, fmt.Errorf("encryption key has no id")
+	}
+
+	text := c.Key.Value()
+	if c.File != "" {
+		bytes, err := os.ReadFile(c.File)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key '%s': %w", c.ID, err)
+		}
+		text = strings.TrimSpace(string(bytes))
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(secret) != 32 {
+		return nil, fmt.Errorf("encryption key '%s': the key must be 32 base64 bytes", c.ID)
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key '%s': %w", c.ID, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key '%s': %w", c.ID, err)
+	}
+
+	return &key{id: c.ID, aead: aead}, nil
+}
+
+// RequestData is the additional data authenticated with a request, so it cannot be replayed on another topic or
+// have its reply sent to another response topic
+func RequestData(topic string, responseTopic string) []byte {
+	return []byte("request\x00" + topic + "\x00" + responseTopic)
+}
+
+// ReplyData is the additional data authenticated with a reply, which ties it to the request
+func ReplyData(topic string, correlationData []byte) []byte {
+	return []byte("reply\x00" + topic + "\x00" + string(correlationData))
+}
+
+// Encrypted reports whether the publish says its payload is encrypted
+func Encrypted(properties *paho.PublishProperties) bool {
+	return properties != nil && properties.User.Get(AlgorithmProperty) != ""
+}
+
+// Seal encrypts the payload with the given key, or the first key when keyID is empty, and records the key in the
+// user properties. A nil Keyring returns the payload unchanged
+func (k *Keyring) Seal(properties *paho.PublishProperties, keyID string, payload []byte, data []byte) ([]byte, error) {
+
+	if k == nil {
+		return payload, nil
+	}
+
+	key := k.keys[0]
+	if keyID != "" {
+		key = k.byID[keyID]
+		if key == nil {
+			return nil, fmt.Errorf("unknown encryption key: %s", keyID)
+		}
+	}
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	properties.User.Add(AlgorithmProperty, A256GCM)
+	properties.User.Add(KeyIDProperty, key.id)
+
+	return key.aead.Seal(nonce, nonce, payload, data), nil
+}
+
+// Open decrypts the payload and returns the id of the key it was encrypted with. A payload in the clear is returned
+// unchanged, with an empty key id, unless encryption is required
+func (k *Keyring) Open(properties *paho.PublishProperties, payload []byte, data []byte) ([]byte, string, error) {
+
+	if !Encrypted(properties) {
+		if k != nil && k.required {
+			return nil, "", ErrNotEncrypted
+		}
+		return payload, "", nil
+	}
+
+	if k == nil {
+		return nil, "", fmt.Errorf("payload is encrypted, but no keys are configured")
+	}
+
+	algorithm := properties.User.Get(AlgorithmProperty)
+	if algorithm != A256GCM {
+		return nil, "", fmt.Errorf("unexpected encryption: %s", algorithm)
+	}
+
+	keyID := properties.User.Get(KeyIDProperty)
+	key := k.byID[keyID]
+	if key == nil {
+		return nil, "", fmt.Errorf("unknown encryption key: %s", keyID)
+	}
+
+	size := key.aead.NonceSize()
+	if len(payload) < size {
+		return nil, "", fmt.Errorf("encrypted payload is too short")
+	}
+
+	plaintext, err := key.aead.Open(nil, payload[:size], payload[size:], data)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decrypt payload with key '%s': %w", keyID, err)
+	}
+
+	return plaintext, keyID, nil
+}
@@ -1,37 +1,245 @@
 package loggerlevel
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+// The components which can be given their own level. Anything else logs at the default level
+const (
+	Default  = ""
+	Mqtt     = "mqtt"     // Connections to the broker, and the messages sent and received
+	DB       = "db"       // Connections to the database
+	Handlers = "handlers" // The Responder's request handlers
 )
 
+var components = []string{Mqtt, DB, Handlers}
+
+var (
+	root atomic.Pointer[slog.Handler]
+
+	mutex        sync.RWMutex
+	defaultLevel = slog.LevelInfo
+	levels       = map[string]slog.Level{}
+	payloads     = "off"
+	payloadLimit = 256
+)
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	root.Store(&h)
+	slog.SetDefault(Logger(Default))
+}
+
+// SetLoggerLevel sets the default level from the LOGGER_LEVEL environment variable, if it is set
 func SetLoggerLevel() error {
 
 	value, exists := os.LookupEnv("LOGGER_LEVEL")
 
 	if exists {
-
-		level := slog.LevelInfo
-
-		switch strings.ToLower(value) {
-		case "debug":
-			level = slog.LevelDebug
-		case "info":
-			level = slog.LevelInfo
-		case "warn":
-			level = slog.LevelWarn
-		case "error":
-			level = slog.LevelError
-		default:
+		level, err := ParseLevel(value)
+		if err != nil {
 			text := fmt.Sprintf("Unexpected logging level: env LOGGER_LEVEL = %s", value)
 			slog.Info(text)
 			return fmt.Errorf(text)
 		}
 
-		slog.SetLogLoggerLevel(level)
+		mutex.Lock()
+		defer mutex.Unlock()
+		defaultLevel = level
+	}
+
+	return nil
+}
+
+// Configure sets up logging from the configuration. LOGGER_LEVEL still gives the default level when
+// logging.level is not set. It can be called again, e.g. when the configuration is reloaded, and changes
+// nothing if the configuration is not valid
+func Configure(c *config.LoggingConfig) error {
+
+	var h slog.Handler
+	switch c.Format {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	default:
+		return fmt.Errorf("unexpected logging format: %s", c.Format)
+	}
+
+	level := slog.LevelInfo
+	text := c.Level
+	if text == "" {
+		text = os.Getenv("LOGGER_LEVEL")
+	}
+	if text != "" {
+		var err error
+		level, err = ParseLevel(text)
+		if err != nil {
+			return err
+		}
+	}
+
+	componentLevels := map[string]slog.Level{}
+	for component, text := range c.Levels {
+		if !known(component) {
+			return fmt.Errorf("unexpected logging component: %s", component)
+		}
+		l, err := ParseLevel(text)
+		if err != nil {
+			return err
+		}
+		componentLevels[component] = l
 	}
 
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	root.Store(&h)
+	defaultLevel = level
+	levels = componentLevels
+	payloads = c.GetPayloads()
+	payloadLimit = c.GetPayloadLimit()
 	return nil
 }
+
+func ParseLevel(value string) (slog.Level, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unexpected logging level: %s", value)
+}
+
+func known(component string) bool {
+	for _, c := range components {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLevel changes the level of a component while running, or the default level if the component is empty
+func SetLevel(component string, text string) error {
+
+	if component != Default && !known(component) {
+		return fmt.Errorf("unexpected logging component: %s", component)
+	}
+	level, err := ParseLevel(text)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if component == Default {
+		defaultLevel = level
+		return nil
+	}
+	changed := map[string]slog.Level{}
+	for c, l := range levels {
+		changed[c] = l
+	}
+	changed[component] = level
+	levels = changed
+	return nil
+}
+
+// Levels reports the level each component logs at, with "default" for the rest
+func Levels() map[string]string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	state := map[string]string{"default": strings.ToLower(defaultLevel.String())}
+	for _, c := range components {
+		state[c] = strings.ToLower(level(c).String())
+	}
+	return state
+}
+
+// level must be called with the mutex held
+func level(component string) slog.Level {
+	if l, ok := levels[component]; ok {
+		return l
+	}
+	return defaultLevel
+}
+
+// Payload describes a message payload for the log. Payloads hold passwords and tokens, so by default only their
+// size is logged
+func Payload(payload []byte) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	switch payloads {
+	case "full":
+		return string(payload)
+	case "truncated":
+		if len(payload) > payloadLimit {
+			return fmt.Sprintf("%s... (%d bytes)", payload[:payloadLimit], len(payload))
+		}
+		return string(payload)
+	}
+	return fmt.Sprintf("(%d bytes)", len(payload))
+}
+
+// Logger returns the logger of a component. Its level and format follow any later changes
+func Logger(component string) *slog.Logger {
+	return slog.New(&handler{component: component})
+}
+
+// handler passes the records of one component, at the component's level, on to the root handler
+type handler struct {
+	component string
+	wrap      func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return l >= level(h.component)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	inner := *root.Load()
+	if h.component != Default {
+		inner = inner.WithAttrs([]slog.Attr{slog.String("component", h.component)})
+	}
+	if h.wrap != nil {
+		inner = h.wrap(inner)
+	}
+	return inner.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.then(func(inner slog.Handler) slog.Handler { return inner.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.then(func(inner slog.Handler) slog.Handler { return inner.WithGroup(name) })
+}
+
+func (h *handler) then(next func(slog.Handler) slog.Handler) slog.Handler {
+	previous := h.wrap
+	return &handler{component: h.component, wrap: func(inner slog.Handler) slog.Handler {
+		if previous != nil {
+			inner = previous(inner)
+		}
+		return next(inner)
+	}}
+}
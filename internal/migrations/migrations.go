@@ -0,0 +1,375 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The migrations are numbered files, each with an up and usually a down script, e.g. 0003_create_diaries.up.sql
+//
+//go:embed sql/*.sql
+var files embed.FS
+
+var filename = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// lockID identifies the advisory lock held while migrating, so only one process changes the schema at a time
+const lockID int64 = 0x64696172696573 // "diaries"
+
+const table = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	checksum   TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string // Empty if the migration cannot be undone
+	Checksum string // Of the up script, so a change to an applied migration is noticed
+}
+
+// Status is the state of one migration. Applied is nil if the migration is pending
+type Status struct {
+	Version  int
+	Name     string
+	Applied  *time.Time
+	Embedded bool // False for a migration recorded in the database which this build does not know
+	Modified bool // The up script has changed since it was applied
+}
+
+// ErrSchema says the schema is not the one this build expects
+var ErrSchema = errors.New("database schema")
+
+// All returns the embedded migrations in order
+func All() ([]Migration, error) {
+
+	entries, err := fs.ReadDir(files, "sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := filename.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file: %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+
+		bytes, err := files.ReadFile(path.Join("sql", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(bytes)
+			sum := sha256.Sum256(bytes)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(bytes)
+		}
+	}
+
+	list := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", m.Version)
+		}
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// Latest is the version of the schema this build expects
+func Latest() (int, error) {
+	list, err := All()
+	if err != nil || len(list) == 0 {
+		return 0, err
+	}
+	return list[len(list)-1].Version, nil
+}
+
+type applied struct {
+	name     string
+	checksum string
+	at       time.Time
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// recorded reads schema_migrations, which is empty if it does not exist yet
+func recorded(ctx context.Context, q querier) (map[int]applied, error) {
+
+	var exists bool
+	if err := q.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return map[int]applied{}, nil
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[int]applied{}
+	for rows.Next() {
+		var version int
+		var a applied
+		if err := rows.Scan(&version, &a.name, &a.checksum, &a.at); err != nil {
+			return nil, err
+		}
+		result[version] = a
+	}
+	return result, rows.Err()
+}
+
+// GetStatus lists every migration, embedded or recorded, in order
+func GetStatus(ctx context.Context, db *sql.DB) ([]Status, error) {
+
+	list, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := recorded(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Status
+	for _, m := range list {
+		s := Status{Version: m.Version, Name: m.Name, Embedded: true}
+		if a, ok := done[m.Version]; ok {
+			at := a.at
+			s.Applied = &at
+			s.Modified = a.checksum != m.Checksum
+			delete(done, m.Version)
+		}
+		result = append(result, s)
+	}
+	for version, a := range done {
+		at := a.at
+		result = append(result, Status{Version: version, Name: a.name, Applied: &at})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, nil
+}
+
+// Check makes sure every migration has been applied, unchanged, and that the database has none this build does
+// not know. It is called at startup, and does not change anything
+func Check(ctx context.Context, db *sql.DB) error {
+
+	list, err := GetStatus(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	latest, err := Latest()
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	for _, s := range list {
+		switch {
+		case !s.Embedded:
+			return fmt.Errorf("%w: migration %d (%s) is newer than this build, which expects version %d", ErrSchema, s.Version, s.Name, latest)
+		case s.Applied == nil:
+			return fmt.Errorf("%w: at version %d, but version %d is expected. Run 'Migrate up'", ErrSchema, version, latest)
+		case s.Modified:
+			return fmt.Errorf("%w: migration %d (%s) has changed since it was applied. Run 'Migrate repair' if the change is intended", ErrSchema, s.Version, s.Name)
+		}
+		version = s.Version
+	}
+	return nil
+}
+
+// withLock runs fn on one connection, holding the advisory lock, so concurrent migrations wait their turn
+func withLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID); err != nil {
+		return fmt.Errorf("could not lock the schema: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+
+	if _, err := conn.ExecContext(ctx, table); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// Up applies the pending migrations, up to and including the target version, or all of them if the target is 0.
+// Each migration is applied in a transaction, together with its record in schema_migrations. It returns the
+// versions which were applied
+func Up(ctx context.Context, db *sql.DB, target int) ([]int, error) {
+
+	list, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []int
+	err = withLock(ctx, db, func(conn *sql.Conn) error {
+
+		records, err := recorded(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range list {
+			if target > 0 && m.Version > target {
+				break
+			}
+			if a, ok := records[m.Version]; ok {
+				if a.checksum != m.Checksum {
+					return fmt.Errorf("%w: migration %d (%s) has changed since it was applied", ErrSchema, m.Version, m.Name)
+				}
+				continue
+			}
+
+			err := transaction(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`, m.Version, m.Name, m.Checksum)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down undoes the applied migrations above the target version, newest first. It returns the versions which were
+// undone
+func Down(ctx context.Context, db *sql.DB, target int) ([]int, error) {
+
+	list, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []int
+	err = withLock(ctx, db, func(conn *sql.Conn) error {
+
+		records, err := recorded(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(list) - 1; i >= 0; i-- {
+			m := list[i]
+			if m.Version <= target {
+				break
+			}
+			if _, ok := records[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d (%s) cannot be undone", m.Version, m.Name)
+			}
+
+			err := transaction(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("undoing migration %d (%s) failed: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Repair records the checksums of the embedded migrations in place of those applied, for when an applied
+// migration was changed on purpose, e.g. to fix a comment. It returns the versions which were updated
+func Repair(ctx context.Context, db *sql.DB) ([]int, error) {
+
+	list, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []int
+	err = withLock(ctx, db, func(conn *sql.Conn) error {
+
+		records, err := recorded(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range list {
+			a, ok := records[m.Version]
+			if !ok || a.checksum == m.Checksum {
+				continue
+			}
+			_, err := conn.ExecContext(ctx, `UPDATE schema_migrations SET name = $2, checksum = $3 WHERE version = $1`, m.Version, m.Name, m.Checksum)
+			if err != nil {
+				return err
+			}
+			done = append(done, m.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+func transaction(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
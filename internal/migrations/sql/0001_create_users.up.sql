@@ -0,0 +1,20 @@
+-- IF NOT EXISTS lets a database made before there were migrations be brought under them
+CREATE TABLE IF NOT EXISTS users (
+	id            SERIAL PRIMARY KEY,
+	username      TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	failed_logins INTEGER NOT NULL DEFAULT 0,
+	locked_until  TIMESTAMPTZ,
+	created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id           TEXT PRIMARY KEY,
+	user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	refresh_hash TEXT NOT NULL,
+	client_id    TEXT NOT NULL DEFAULT '',
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+	expires_at   TIMESTAMPTZ NOT NULL,
+	revoked_at   TIMESTAMPTZ
+);
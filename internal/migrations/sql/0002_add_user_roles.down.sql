@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS broker_password_hash;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'reader';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS broker_password_hash TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS diary_access;
+DROP TABLE IF EXISTS pages;
+DROP TABLE IF EXISTS diaries;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS diaries (
+	id         SERIAL PRIMARY KEY,
+	title      TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS pages (
+	id       SERIAL PRIMARY KEY,
+	diary_id INTEGER NOT NULL REFERENCES diaries(id) ON DELETE CASCADE,
+	number   INTEGER NOT NULL,
+	title    TEXT NOT NULL DEFAULT '',
+	UNIQUE (diary_id, number)
+);
+
+CREATE TABLE IF NOT EXISTS diary_access (
+	diary_id INTEGER NOT NULL REFERENCES diaries(id) ON DELETE CASCADE,
+	user_id  INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	access   TEXT NOT NULL CHECK (access IN ('read', 'write')),
+	PRIMARY KEY (diary_id, user_id)
+);
@@ -0,0 +1,89 @@
+package mosquitto
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rsmaxwell/diaries/internal/authz"
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+// Account is a broker user and the diaries role which decides its topics
+type Account struct {
+	Username string
+	Role     string
+}
+
+// Topics are the broker topics the diaries use
+type Topics struct {
+	Request    string
+	Response   string // With %u in place of the username and + in place of the client id
+	Status     string // With + in place of the client id
+	DeadLetter string
+}
+
+func NewTopics(c *config.Config) *Topics {
+	return &Topics{
+		Request:    c.Topics.GetRequest(),
+		Response:   c.Topics.GetResponse("%u", "+"),
+		Status:     c.Topics.GetStatus("+"),
+		DeadLetter: c.Topics.GetTopic(c.DeadLetter.GetTopic()) + "/#",
+	}
+}
+
+// Rule gives an account read, write or readwrite access to a topic
+type Rule struct {
+	Access string
+	Topic  string
+}
+
+// Rules are the topics of an account with the given role, where %u stands for the account's username. Every user may
+// send requests, read the replies on their own response topics and see whether the Responder is online; only admins
+// may inspect, replay and purge the dead letters
+func (t *Topics) Rules(role string) []Rule {
+	rules := []Rule{
+		{"write", t.Request},
+		{"read", t.Response},
+		{"read", t.Status},
+	}
+	if role == authz.Admin {
+		rules = append(rules, Rule{"readwrite", t.DeadLetter})
+	}
+	return rules
+}
+
+// ACLFile returns the content of a Mosquitto acl_file. Each user may only read the replies on the response topics
+// below their own username. The output depends only on its inputs, so it can be diffed
+func ACLFile(responder string, accounts []Account, topics *Topics) []byte {
+
+	var b bytes.Buffer
+	b.WriteString("# Generated from the diaries users. Changes made here will be lost\n")
+
+	if responder != "" {
+		b.WriteString("\n# The Responder\n")
+		fmt.Fprintf(&b, "user %s\n", responder)
+		fmt.Fprintf(&b, "topic read %s\n", topics.Request)
+		fmt.Fprintf(&b, "topic write %s\n", strings.ReplaceAll(topics.Response, "%u", "+"))
+		fmt.Fprintf(&b, "topic write %s\n", topics.Status)
+		fmt.Fprintf(&b, "topic write %s\n", topics.DeadLetter)
+	}
+
+	sorted := make([]Account, len(accounts))
+	copy(sorted, accounts)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Username < sorted[j].Username })
+
+	for _, account := range sorted {
+		if account.Username == responder {
+			continue
+		}
+		fmt.Fprintf(&b, "\n# role: %s\n", account.Role)
+		fmt.Fprintf(&b, "user %s\n", account.Username)
+		for _, r := range topics.Rules(account.Role) {
+			fmt.Fprintf(&b, "topic %s %s\n", r.Access, strings.ReplaceAll(r.Topic, "%u", account.Username))
+		}
+	}
+
+	return b.Bytes()
+}
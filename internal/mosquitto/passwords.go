@@ -0,0 +1,71 @@
+package mosquitto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The password hash format of Mosquitto 2, as written by mosquitto_passwd: $7$<iterations>$<salt>$<hash>,
+// which is PBKDF2 with SHA-512. The users log on to the broker with their login password, so its broker hash must
+// be as slow to brute-force as the bcrypt one; mosquitto_passwd's default of 101 iterations is far too few
+const (
+	iterations = 210000
+	saltSize   = 12
+)
+
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// DerivedSalt is a salt made from the username and password, for accounts whose hash is not stored anywhere but
+// must still come out the same each time the password file is generated
+func DerivedSalt(username string, password string) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte("diaries-broker-salt:" + username))
+	return mac.Sum(nil)[:saltSize]
+}
+
+func HashPassword(password string, salt []byte) string {
+	hash := pbkdf2.Key([]byte(password), salt, iterations, sha512.Size, sha512.New)
+	return fmt.Sprintf("$7$%d$%s$%s", iterations, base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(hash))
+}
+
+// Weak reports whether the hash was made with fewer iterations than HashPassword uses now, or is not a hash it made
+func Weak(hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != "7" {
+		return true
+	}
+	n, err := strconv.Atoi(parts[2])
+	return err != nil || n < iterations
+}
+
+// PasswordFile returns the content of a Mosquitto password_file, sorted by username
+func PasswordFile(hashes map[string]string) []byte {
+
+	usernames := make([]string, 0, len(hashes))
+	for username := range hashes {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var b bytes.Buffer
+	for _, username := range usernames {
+		fmt.Fprintf(&b, "%s:%s\n", username, hashes[username])
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,34 @@
+package prompt
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var reader = bufio.NewReader(os.Stdin)
+
+// Password asks for a password on the terminal, without echoing it. When the input is not a terminal, such as a
+// pipe, the password is read from the next line
+func Password(label string) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s: %w", strings.ToLower(label), err)
+		}
+		return string(password), nil
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("could not read %s: %w", strings.ToLower(label), err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// sweep is how many of the least recently used buckets are looked at when a new key needs room
+const sweep = 16
+
+type BucketState struct {
+	Tokens float64 `json:"tokens"`
+	Burst  int     `json:"burst"`
+	Rate   float64 `json:"rate"`
+}
+
+// Limiter keeps a token bucket for each key. A key with no limit, or a rate of 0, is never limited
+type Limiter struct {
+	mutex      sync.Mutex
+	limits     map[string]config.RateLimit
+	fallback   *config.RateLimit
+	buckets    map[string]*list.Element
+	recent     *list.List // The buckets, most recently used first
+	maxBuckets int        // 0 for no limit
+	lastPrune  time.Time
+}
+
+// New returns a limiter which keeps at most maxBuckets buckets at once, or any number if it is 0. A new key which
+// would go over the maximum is refused, unless one of the least recently used buckets has filled up again
+func New(fallback *config.RateLimit, limits map[string]config.RateLimit, maxBuckets int) *Limiter {
+	l := new(Limiter)
+	l.fallback = fallback
+	l.limits = limits
+	l.buckets = make(map[string]*list.Element)
+	l.recent = list.New()
+	l.maxBuckets = maxBuckets
+	return l
+}
+
+func (l *Limiter) limitFor(key string) (config.RateLimit, bool) {
+	limit, ok := l.limits[key]
+	if !ok {
+		if l.fallback == nil {
+			return config.RateLimit{}, false
+		}
+		limit = *l.fallback
+	}
+	return limit, limit.Rate > 0
+}
+
+// Allow takes a token from the bucket for the key. When the bucket is empty it returns false,
+// and how long to wait before a token will be available
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limit, ok := l.limitFor(key)
+	if !ok {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.prune(now)
+
+	var b *bucket
+	if e := l.buckets[key]; e != nil {
+		l.recent.MoveToFront(e)
+		b = e.Value.(*bucket)
+	} else {
+		if l.maxBuckets > 0 && len(l.buckets) >= l.maxBuckets {
+			l.evict(now)
+			if len(l.buckets) >= l.maxBuckets {
+				return false, time.Second
+			}
+		}
+		b = &bucket{key: key, tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = l.recent.PushFront(b)
+	}
+	refill(b, limit, now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// State reports the current number of tokens in each active bucket
+func (l *Limiter) State() map[string]BucketState {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	state := make(map[string]BucketState)
+	for key, e := range l.buckets {
+		b := e.Value.(*bucket)
+		limit, _ := l.limitFor(key)
+		refill(b, limit, now)
+		state[key] = BucketState{Tokens: math.Floor(b.tokens), Burst: limit.Burst, Rate: limit.Rate}
+	}
+	return state
+}
+
+func refill(b *bucket, limit config.RateLimit, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	b.last = now
+}
+
+// full refills the bucket, and reports whether it has filled up again, which makes it no different to a new bucket
+func (l *Limiter) full(b *bucket, now time.Time) bool {
+	limit, _ := l.limitFor(b.key)
+	refill(b, limit, now)
+	return b.tokens >= float64(limit.Burst)
+}
+
+func (l *Limiter) remove(e *list.Element) {
+	l.recent.Remove(e)
+	delete(l.buckets, e.Value.(*bucket).key)
+}
+
+// prune forgets the buckets which have filled up again. It only looks once a minute
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	for e := l.recent.Front(); e != nil; {
+		next := e.Next()
+		if l.full(e.Value.(*bucket), now) {
+			l.remove(e)
+		}
+		e = next
+	}
+}
+
+// evict makes room for a new key by forgetting those of the least recently used buckets which have filled up again.
+// Only a few are looked at, so a new key costs the same however many buckets there are
+func (l *Limiter) evict(now time.Time) {
+	e := l.recent.Back()
+	for i := 0; i < sweep && e != nil; i++ {
+		prev := e.Prev()
+		if l.full(e.Value.(*bucket), now) {
+			l.remove(e)
+		}
+		e = prev
+	}
+}
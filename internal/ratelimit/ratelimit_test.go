@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+func TestZeroRateIsUnlimited(t *testing.T) {
+
+	l := New(&config.RateLimit{Rate: 0, Burst: 1}, nil, 0)
+	for i := 0; i < 10; i++ {
+		if ok, wait := l.Allow("alice"); !ok {
+			t.Fatalf("request %d was refused, with a wait of %s", i, wait)
+		}
+	}
+	if state := l.State(); len(state) != 0 {
+		t.Errorf("State = %v, want no buckets", state)
+	}
+}
+
+func TestMaxBuckets(t *testing.T) {
+
+	l := New(&config.RateLimit{Rate: 0.001, Burst: 2}, nil, 3)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(fmt.Sprintf("user%d", i)); !ok {
+			t.Fatalf("user%d was refused", i)
+		}
+	}
+
+	if ok, _ := l.Allow("user3"); ok {
+		t.Errorf("a new key was allowed while every bucket is in use")
+	}
+
+	// A bucket which has filled up again makes room for a new key
+	l.buckets["user0"].Value.(*bucket).tokens = 2
+	if ok, _ := l.Allow("user3"); !ok {
+		t.Errorf("a new key was refused, although a bucket had filled up again")
+	}
+	if _, ok := l.buckets["user0"]; ok {
+		t.Errorf("the full bucket was kept")
+	}
+	if len(l.buckets) != l.recent.Len() {
+		t.Errorf("%d buckets, but %d in the list", len(l.buckets), l.recent.Len())
+	}
+}
@@ -6,6 +6,9 @@ import (
 
 type Request struct {
 	Function string                 `json:"function"`
+	Priority string                 `json:"priority,omitempty"`
+	ClientID string                 `json:"clientId,omitempty"` // Client the request is from, if not given in the 'clientId' user property
+	Token    string                 `json:"token,omitempty"`    // Bearer token, if not given in the 'authorization' user property
 	Args     map[string]interface{} `json:"args"`
 }
 
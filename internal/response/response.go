@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"math"
 	"net/http"
+	"time"
 
 	"github.com/rsmaxwell/diaries/internal/buildinfo"
 )
@@ -57,6 +58,22 @@ func BadRequest(message string) *Response {
 	return &r
 }
 
+func Unauthorized(message string) *Response {
+	r := make(Response)
+	slog.Info(message)
+	r.PutCode(http.StatusUnauthorized)
+	r.PutMessage(message)
+	return &r
+}
+
+func Forbidden(message string) *Response {
+	r := make(Response)
+	slog.Info(message)
+	r.PutCode(http.StatusForbidden)
+	r.PutMessage(message)
+	return &r
+}
+
 func InternalServerError(message string) *Response {
 	r := make(Response)
 	slog.Info(message)
@@ -65,6 +82,35 @@ func InternalServerError(message string) *Response {
 	return &r
 }
 
+// TooManyRequests rejects a request which exceeded a rate limit, with a hint of how many seconds to wait before retrying
+func TooManyRequests(message string, retryAfter time.Duration) *Response {
+	r := make(Response)
+	slog.Info(message)
+	r.PutCode(http.StatusTooManyRequests)
+	r.PutMessage(message)
+	r.PutNumber("retryAfter", math.Ceil(retryAfter.Seconds()*1000)/1000)
+	return &r
+}
+
+// ServiceUnavailable rejects a request which could not be queued, with a hint of how many seconds to wait before
+// retrying
+func ServiceUnavailable(message string, retryAfter time.Duration) *Response {
+	r := make(Response)
+	slog.Info(message)
+	r.PutCode(http.StatusServiceUnavailable)
+	r.PutMessage(message)
+	r.PutNumber("retryAfter", math.Ceil(retryAfter.Seconds()*1000)/1000)
+	return &r
+}
+
+func (r *Response) GetRetryAfter() (time.Duration, error) {
+	n, err := r.GetNumber("retryAfter")
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n * float64(time.Second)), nil
+}
+
 func (r *Response) PutBuildInfo(value *buildinfo.BuildInfo) {
 	(*r)["version"] = value.Version
 	(*r)["buildDate"] = value.BuildDate
@@ -165,3 +211,16 @@ func (r *Response) GetBoolean(key string) (bool, error) {
 	}
 	return v, nil
 }
+
+func (r *Response) PutObject(key string, value interface{}) {
+	(*r)[key] = value
+}
+
+func (r *Response) GetObject(key string) (map[string]interface{}, error) {
+	value := (*r)[key]
+	v, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected type for '%s': %+v", key, value)
+	}
+	return v, nil
+}
@@ -0,0 +1,286 @@
+/* see:
+ *    https://github.com/eclipse/paho.golang/blob/v0.21.0/autopaho/examples/basics/basics.go
+ *    https://github.com/eclipse/paho.golang/blob/master/autopaho/examples/rpc/main.go
+ */
+
+package rpcclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/connection"
+	"github.com/rsmaxwell/diaries/internal/encryption"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/request"
+	"github.com/rsmaxwell/diaries/internal/response"
+	"github.com/rsmaxwell/diaries/internal/signing"
+)
+
+var logger = loggerlevel.Logger(loggerlevel.Mqtt)
+
+// Client sends requests to the Responder and waits for the replies, which are matched to their requests by the
+// CorrelationData
+type Client struct {
+	cm            *autopaho.ConnectionManager
+	qos           byte
+	requestTopic  string
+	responseTopic string
+	clientID      string
+	token         string
+	keyring       *encryption.Keyring
+	signer        *signing.Signer
+	registry      *signing.Registry
+
+	mu      sync.Mutex
+	pending map[string]chan *paho.Publish
+}
+
+// Connect connects to the broker as the given component, e.g. "requester"
+func Connect(ctx context.Context, config *config.Config, component string) (*Client, error) {
+
+	mqttConfig, err := connection.NewTransientConfig(ctx, &config.Mqtt, component)
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection's client id is new on every run, but the client id the requests are sent as stays the same, so
+	// it can be named in a token and in the broker's ACL. Runs at once share the response topic, and each drops the
+	// replies to the others' requests
+	clientID, err := config.Mqtt.GetClientID(component)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := encryption.NewKeyring(&config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := signing.NewSigner(&config.Signing)
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := signing.NewRegistry(&config.Signing)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := LoadToken()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		qos:           config.Mqtt.GetQoS(),
+		requestTopic:  config.Topics.GetRequest(),
+		responseTopic: config.Topics.GetResponse(config.Mqtt.GetUsername(), clientID),
+		clientID:      clientID,
+		token:         token,
+		keyring:       keyring,
+		signer:        signer,
+		registry:      registry,
+		pending:       make(map[string]chan *paho.Publish),
+	}
+
+	initialSubscriptionMade := make(chan struct{}) // Closed when subscription made (otherwise we might send request before subscription in place)
+	var initialSubscriptionOnce sync.Once          // We only want to close the above once!
+
+	mqttConfig.OnConnectionUp = func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5*time.Second))
+		defer cancel()
+
+		// Subscribe to the responseTopic
+		if _, err := cm.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{
+				{Topic: c.responseTopic, QoS: c.qos},
+			},
+		}); err != nil {
+			logger.Error("failed to subscribe, so no replies will be received", "topic", c.responseTopic, "error", err)
+			return
+		}
+		initialSubscriptionOnce.Do(func() { close(initialSubscriptionMade) })
+	}
+
+	mqttConfig.OnPublishReceived = []func(paho.PublishReceived) (bool, error){
+		func(p paho.PublishReceived) (bool, error) {
+			c.deliver(p.Packet)
+			return true, nil
+		}}
+
+	c.cm, err = autopaho.NewConnection(ctx, *mqttConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for the subscription to be made (otherwise we may miss the response!)
+	connCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	select {
+	case <-connCtx.Done():
+		return nil, fmt.Errorf("requestor failed to connect & subscribe: %s", connCtx.Err())
+	case <-initialSubscriptionMade:
+	}
+
+	return c, nil
+}
+
+// deliver passes a reply to the request waiting for it. Replies to requests which have given up are dropped
+func (c *Client) deliver(reply *paho.Publish) {
+
+	if reply.Properties == nil {
+		return
+	}
+
+	c.mu.Lock()
+	ch := c.pending[string(reply.Properties.CorrelationData)]
+	delete(c.pending, string(reply.Properties.CorrelationData))
+	c.mu.Unlock()
+
+	if ch == nil {
+		logger.Debug(fmt.Sprintf("dropping unexpected reply on %s", reply.Topic))
+		return
+	}
+	ch <- reply
+}
+
+func (c *Client) await(correlationData string) chan *paho.Publish {
+	ch := make(chan *paho.Publish, 1)
+	c.mu.Lock()
+	c.pending[correlationData] = ch
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *Client) forget(correlationData string) {
+	c.mu.Lock()
+	delete(c.pending, correlationData)
+	c.mu.Unlock()
+}
+
+// SetToken changes the bearer token sent with later requests
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// Request sends the request and waits up to the timeout for the reply. The request expires on the
+// broker at the same time, so it is not delivered to the Responder after the caller has given up
+func (c *Client) Request(ctx context.Context, r *request.Request, timeout time.Duration) (*response.Response, error) {
+
+	j, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// When the request is encrypted, the client id and token go inside it, where they cannot be read or changed
+	envelope := j
+	if c.keyring != nil {
+		sealed := *r
+		sealed.ClientID = c.clientID
+		sealed.Token = c.token
+		envelope, err = json.Marshal(&sealed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	expiry := uint32(math.Ceil(timeout.Seconds()))
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	correlationData := hex.EncodeToString(id)
+
+	properties := &paho.PublishProperties{
+		MessageExpiry:   &expiry,
+		CorrelationData: []byte(correlationData),
+		ResponseTopic:   c.responseTopic,
+	}
+
+	// The Responder only sends the reply to the response topic of this client
+	if c.keyring == nil {
+		properties.User.Add("clientId", c.clientID)
+		if c.token != "" {
+			properties.User.Add("authorization", "Bearer "+c.token)
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Sending request: %s", r.Function))
+	logger.Debug(fmt.Sprintf("request: %s", loggerlevel.Payload(j)))
+
+	// The request is signed before it is encrypted, so the signature is over what the Responder acts on
+	err = c.signer.Sign(properties, signing.Message{Function: r.Function, CorrelationData: properties.CorrelationData, ResponseTopic: c.responseTopic}, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := c.keyring.Seal(properties, "", envelope, encryption.RequestData(c.requestTopic, c.responseTopic))
+	if err != nil {
+		return nil, err
+	}
+
+	replies := c.await(correlationData)
+	defer c.forget(correlationData)
+
+	_, err = c.cm.Publish(ctx, &paho.Publish{
+		QoS:        c.qos,
+		Topic:      c.requestTopic,
+		Payload:    payload,
+		Properties: properties,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var reply *paho.Publish
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no response within %s: %w", timeout, ctx.Err())
+	case reply = <-replies:
+	}
+
+	// An encrypted request must get an encrypted reply, so the reply cannot be replaced by one in the clear
+	if c.keyring != nil && !encryption.Encrypted(reply.Properties) {
+		return nil, fmt.Errorf("reply was not encrypted")
+	}
+
+	body, _, err := c.keyring.Open(reply.Properties, reply.Payload, encryption.ReplyData(reply.Topic, reply.Properties.CorrelationData))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt response: %w", err)
+	}
+
+	signer, err := c.registry.Verify(reply.Properties, signing.Message{CorrelationData: reply.Properties.CorrelationData, ResponseTopic: reply.Topic}, body)
+	if err != nil {
+		return nil, fmt.Errorf("could not verify response: %w", err)
+	}
+	if signer != "" {
+		logger.Debug(fmt.Sprintf("response signed by: %s", signer))
+	}
+	logger.Debug(fmt.Sprintf("response: %s", loggerlevel.Payload(body)))
+
+	var resp response.Response
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("could not decode response: %v", err)
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) Disconnect(ctx context.Context) error {
+	return c.cm.Disconnect(ctx)
+}
@@ -0,0 +1,85 @@
+package rpcclient
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+const (
+	tokenFile        = "token"
+	refreshTokenFile = "refresh_token"
+)
+
+// LoadToken returns the bearer token sent with each request, from the DIARIES_TOKEN environment
+// variable or else the ~/.diaries/token file. There may be none
+func LoadToken() (string, error) {
+	if token, ok := os.LookupEnv("DIARIES_TOKEN"); ok {
+		return strings.TrimSpace(token), nil
+	}
+	return readFile(tokenFile)
+}
+
+func LoadRefreshToken() (string, error) {
+	return readFile(refreshTokenFile)
+}
+
+// SaveTokens keeps the tokens from a login, so later requests are sent as the user
+func SaveTokens(accessToken string, refreshToken string) error {
+	if err := writeFile(tokenFile, accessToken); err != nil {
+		return err
+	}
+	return writeFile(refreshTokenFile, refreshToken)
+}
+
+// RemoveTokens forgets the tokens, on logout
+func RemoveTokens() error {
+	for _, name := range []string{tokenFile, refreshTokenFile} {
+		filename, err := tokenPath(name)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func tokenPath(name string) (string, error) {
+	dirname, err := config.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dirname, name), nil
+}
+
+func readFile(name string) (string, error) {
+	filename, err := tokenPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	bytes, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bytes)), nil
+}
+
+func writeFile(name string, value string) error {
+	filename, err := tokenPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, []byte(value+"\n"), 0600)
+}
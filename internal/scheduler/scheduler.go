@@ -0,0 +1,157 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Priority int
+
+const (
+	Low Priority = iota
+	Normal
+	High
+)
+
+var names = [...]string{"low", "normal", "high"}
+
+func (p Priority) String() string {
+	return names[p]
+}
+
+func ParsePriority(value string) (Priority, error) {
+	for i, name := range names {
+		if strings.EqualFold(value, name) {
+			return Priority(i), nil
+		}
+	}
+	return Normal, fmt.Errorf("unexpected priority: %s", value)
+}
+
+type task struct {
+	run      func()
+	enqueued time.Time
+}
+
+// Scheduler runs tasks from a FIFO lane for each priority. The next task is taken from the lane whose oldest task
+// has the highest priority once it has been aged, where every 'aging' interval spent waiting raises a task by one
+// priority, so low priority work still makes progress while high priority work keeps arriving. Each lane holds at
+// most 'capacity' tasks, so a flood of requests cannot use up the memory
+type Scheduler struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	lanes    [len(names)][]task
+	aging    time.Duration
+	capacity int
+}
+
+func New(aging time.Duration, capacity int) *Scheduler {
+	s := new(Scheduler)
+	s.cond = sync.NewCond(&s.mutex)
+	s.aging = aging
+	s.capacity = capacity
+	return s
+}
+
+// Submit queues the task in the lane for its priority. It reports false, without queueing the task, when the lane
+// is full
+func (s *Scheduler) Submit(priority Priority, run func()) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.capacity > 0 && len(s.lanes[priority]) >= s.capacity {
+		return false
+	}
+
+	s.lanes[priority] = append(s.lanes[priority], task{run: run, enqueued: time.Now()})
+	s.cond.Signal()
+	return true
+}
+
+// SetAging changes how quickly waiting tasks are raised, for the tasks already waiting too
+func (s *Scheduler) SetAging(aging time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.aging = aging
+}
+
+// SetCapacity changes the number of tasks each lane can hold. Tasks already waiting beyond it are still run
+func (s *Scheduler) SetCapacity(capacity int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.capacity = capacity
+}
+
+// Run starts the workers, which run tasks until the context is cancelled
+func (s *Scheduler) Run(ctx context.Context, workers int) {
+
+	go func() {
+		<-ctx.Done()
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.cond.Broadcast()
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				run := s.next(ctx)
+				if run == nil {
+					return
+				}
+				run()
+			}
+		}()
+	}
+}
+
+func (s *Scheduler) next(ctx context.Context) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		now := time.Now()
+		best := -1
+		var bestScore float64
+		for p, lane := range s.lanes {
+			if len(lane) == 0 {
+				continue
+			}
+			score := float64(p)
+			if s.aging > 0 {
+				score += float64(now.Sub(lane[0].enqueued)) / float64(s.aging)
+			}
+			if best < 0 || score > bestScore {
+				best, bestScore = p, score
+			}
+		}
+
+		if best >= 0 {
+			t := s.lanes[best][0]
+			s.lanes[best][0] = task{}
+			s.lanes[best] = s.lanes[best][1:]
+			return t.run
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// State reports the number of tasks waiting in each lane
+func (s *Scheduler) State() map[string]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := make(map[string]int)
+	for p, lane := range s.lanes {
+		state[Priority(p).String()] = len(lane)
+	}
+	return state
+}
@@ -0,0 +1,229 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rsmaxwell/diaries/internal/config"
+)
+
+// The user properties of a signed message
+const (
+	SignatureProperty = "signature"
+	KeyIDProperty     = "signatureKeyId"
+	TimestampProperty = "signatureTimestamp"
+	NonceProperty     = "signatureNonce"
+)
+
+var ErrNotSigned = errors.New("message is not signed")
+
+// Message is what is signed along with the payload. Function is empty for replies, which are tied to their
+// request by the CorrelationData. For a reply, ResponseTopic is the topic it is published on
+type Message struct {
+	Function        string
+	CorrelationData []byte
+	ResponseTopic   string
+}
+
+// digest is what the signature is made over. Each field is length prefixed, so fields cannot be run together
+func digest(m Message, keyID string, timestamp string, nonce string, payload []byte) []byte {
+
+	hash := sha256.Sum256(payload)
+
+	var b bytes.Buffer
+	b.WriteString("diaries-signature-v1")
+	for _, field := range [][]byte{[]byte(keyID), []byte(m.Function), m.CorrelationData, []byte(m.ResponseTopic), []byte(timestamp), []byte(nonce), hash[:]} {
+		b.WriteString(strconv.Itoa(len(field)))
+		b.WriteByte(':')
+		b.Write(field)
+	}
+	return b.Bytes()
+}
+
+// Signer signs messages with a private key. A nil Signer leaves messages unsigned
+type Signer struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+// NewSigner returns nil when no key is configured
+func NewSigner(c *config.SigningConfig) (*Signer, error) {
+
+	if c.Key == nil {
+		return nil, nil
+	}
+
+	text := c.Key.PrivateKey.Value()
+	if c.Key.File != "" {
+		bytes, err := os.ReadFile(c.Key.File)
+		if err != nil {
+			return nil, fmt.Errorf("signing key '%s': %w", c.Key.ID, err)
+		}
+		text = strings.TrimSpace(string(bytes))
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key '%s': the private key must be a base64 %d byte seed", c.Key.ID, ed25519.SeedSize)
+	}
+
+	return &Signer{id: c.Key.ID, key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Sign adds the signature, key id, timestamp and nonce to the user properties
+func (s *Signer) Sign(properties *paho.PublishProperties, m Message, payload []byte) error {
+
+	if s == nil {
+		return nil
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(random)
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	signature := ed25519.Sign(s.key, digest(m, s.id, timestamp, nonce, payload))
+
+	properties.User.Add(KeyIDProperty, s.id)
+	properties.User.Add(TimestampProperty, timestamp)
+	properties.User.Add(NonceProperty, nonce)
+	properties.User.Add(SignatureProperty, base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+// Registry holds the trusted public keys, and the nonces seen recently so a signed message cannot be replayed
+type Registry struct {
+	keys     map[string]ed25519.PublicKey
+	required bool
+	window   time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	order  []seenNonce // The nonces in the order they were seen, which is the order they are forgotten in
+}
+
+type seenNonce struct {
+	nonce string
+	seen  time.Time
+}
+
+func NewRegistry(c *config.SigningConfig) (*Registry, error) {
+
+	window, err := c.GetWindow()
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(Registry)
+	r.keys = make(map[string]ed25519.PublicKey)
+	r.required = c.Required
+	r.window = window
+	r.nonces = make(map[string]time.Time)
+
+	for _, tc := range c.Trusted {
+		publicKey, err := base64.StdEncoding.DecodeString(tc.PublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("trusted key '%s': the public key must be %d base64 bytes", tc.ID, ed25519.PublicKeySize)
+		}
+		if _, ok := r.keys[tc.ID]; ok {
+			return nil, fmt.Errorf("trusted key '%s' is listed more than once", tc.ID)
+		}
+		r.keys[tc.ID] = ed25519.PublicKey(publicKey)
+	}
+
+	if r.required && len(r.keys) == 0 {
+		return nil, fmt.Errorf("signatures are required, but no trusted keys are configured")
+	}
+
+	return r, nil
+}
+
+func Signed(properties *paho.PublishProperties) bool {
+	return properties != nil && properties.User.Get(SignatureProperty) != ""
+}
+
+// Verify checks the signature, and returns the id of the key which made it. A message which is not signed is
+// accepted, with an empty key id, unless signatures are required
+func (r *Registry) Verify(properties *paho.PublishProperties, m Message, payload []byte) (string, error) {
+
+	if !Signed(properties) {
+		if r.required {
+			return "", ErrNotSigned
+		}
+		return "", nil
+	}
+
+	keyID := properties.User.Get(KeyIDProperty)
+	publicKey, ok := r.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("signed with an untrusted key: %s", keyID)
+	}
+
+	timestamp := properties.User.Get(TimestampProperty)
+	nonce := properties.User.Get(NonceProperty)
+	if nonce == "" {
+		return "", fmt.Errorf("signature has no nonce")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(properties.User.Get(SignatureProperty))
+	if err != nil {
+		return "", fmt.Errorf("could not decode signature: %w", err)
+	}
+
+	if !ed25519.Verify(publicKey, digest(m, keyID, timestamp, nonce, payload), signature) {
+		return "", fmt.Errorf("signature is not valid")
+	}
+
+	millis, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("unexpected signature timestamp: %s", timestamp)
+	}
+
+	now := time.Now()
+	signed := time.UnixMilli(millis)
+	if signed.Before(now.Add(-r.window)) || signed.After(now.Add(r.window)) {
+		return "", fmt.Errorf("signature timestamp is outside the %s window", r.window)
+	}
+
+	if !r.remember(keyID+"/"+nonce, now) {
+		return "", fmt.Errorf("message has already been received")
+	}
+
+	return keyID, nil
+}
+
+// remember records the nonce, returning false if it has been seen within the window. Nonces older than the window
+// are forgotten, since their messages would be refused for their timestamp anyway
+func (r *Registry) remember(nonce string, now time.Time) bool {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Only the oldest nonces need to be looked at, so each nonce is forgotten once rather than looked at every time
+	expired := 0
+	for expired < len(r.order) && now.Sub(r.order[expired].seen) > 2*r.window {
+		delete(r.nonces, r.order[expired].nonce)
+		expired++
+	}
+	r.order = r.order[expired:]
+
+	if _, ok := r.nonces[nonce]; ok {
+		return false
+	}
+	r.nonces[nonce] = now
+	r.order = append(r.order, seenNonce{nonce: nonce, seen: now})
+	return true
+}
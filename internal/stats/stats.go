@@ -0,0 +1,31 @@
+package stats
+
+import (
+	"sync"
+)
+
+var (
+	mutex    sync.Mutex
+	counters = map[string]int64{}
+)
+
+func Increment(name string) {
+	Add(name, 1)
+}
+
+func Add(name string, delta int64) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	counters[name] += delta
+}
+
+func Snapshot() map[string]int64 {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	snapshot := make(map[string]int64, len(counters))
+	for name, value := range counters {
+		snapshot[name] = value
+	}
+	return snapshot
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/diaries"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+// Seed is the data loaded by the memory driver, e.g.
+//
+//	{
+//	  "users": [{"username": "admin", "password": "changeit!", "role": "admin"}],
+//	  "diaries": [{"title": "1914", "pages": ["January", "February"], "shared": {"alice": "read"}}]
+//	}
+type Seed struct {
+	Users   []SeedUser  `json:"users"`
+	Diaries []SeedDiary `json:"diaries"`
+}
+
+type SeedUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type SeedDiary struct {
+	Title  string            `json:"title"`
+	Pages  []string          `json:"pages"`  // Page titles, in order
+	Shared map[string]string `json:"shared"` // Access by username
+}
+
+func seed(filename string, people users.Repository, books *diaries.Memory) error {
+
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read the seed file: %w", err)
+	}
+
+	var data Seed
+	err = json.Unmarshal(bytes, &data)
+	if err != nil {
+		return fmt.Errorf("could not parse the seed file %s: %w", filename, err)
+	}
+
+	userStore, err := users.NewStore(people, &config.UsersConfig{})
+	if err != nil {
+		return err
+	}
+	for _, u := range data.Users {
+		_, err := userStore.Create(u.Username, u.Password, u.Role)
+		if err != nil {
+			return fmt.Errorf("seed file %s: %w", filename, err)
+		}
+	}
+
+	diaryStore := diaries.NewStore(books)
+	for _, d := range data.Diaries {
+		id := books.AddDiary(d.Title)
+		for _, title := range d.Pages {
+			err := books.AddPage(id, title)
+			if err != nil {
+				return err
+			}
+		}
+		for username, access := range d.Shared {
+			err := diaryStore.Share(id, username, access)
+			if err != nil {
+				return fmt.Errorf("seed file %s: diary '%s': %w", filename, d.Title, err)
+			}
+		}
+	}
+
+	logger.Info(fmt.Sprintf("loaded %d users and %d diaries from %s", len(data.Users), len(data.Diaries), filename))
+	return nil
+}
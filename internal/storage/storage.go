@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/database"
+	"github.com/rsmaxwell/diaries/internal/diaries"
+	"github.com/rsmaxwell/diaries/internal/loggerlevel"
+	"github.com/rsmaxwell/diaries/internal/migrations"
+	"github.com/rsmaxwell/diaries/internal/users"
+)
+
+var logger = loggerlevel.Logger(loggerlevel.DB)
+
+// Storage holds the repositories, backed either by Postgres or, with the memory driver, by nothing at all
+type Storage struct {
+	DB      *sql.DB // Nil with the memory driver
+	Users   users.Repository
+	Diaries diaries.Repository
+}
+
+// Open connects to the database, or with the memory driver starts empty and loads the seed file, if there is one
+func Open(ctx context.Context, c *config.DBConfig) (*Storage, error) {
+
+	if c.Memory() {
+		people := users.NewMemory()
+		books := diaries.NewMemory(people)
+
+		if c.Seed != "" {
+			err := seed(c.Seed, people, books)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		logger.Info("keeping the data in memory")
+		return &Storage{Users: people, Diaries: books}, nil
+	}
+
+	db, err := database.Connect(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{DB: db, Users: users.NewPostgres(db), Diaries: diaries.NewPostgres(db)}, nil
+}
+
+func (s *Storage) Close() error {
+	if s.DB == nil {
+		return nil
+	}
+	return s.DB.Close()
+}
+
+// Check makes sure the database schema is the one this build expects. Memory has no schema
+func (s *Storage) Check(ctx context.Context) error {
+	if s.DB == nil {
+		return nil
+	}
+	return migrations.Check(ctx, s.DB)
+}
+
+// Stats reports the state of the connection pool
+func (s *Storage) Stats() map[string]interface{} {
+	if s.DB == nil {
+		return map[string]interface{}{"driver": "memory"}
+	}
+	return database.Stats(s.DB)
+}
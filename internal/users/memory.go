@@ -0,0 +1,227 @@
+package users
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type memorySession struct {
+	SessionRecord
+	revoked bool
+}
+
+// Memory keeps the users in memory, for demos and tests. Nothing is kept once the process ends
+type Memory struct {
+	mutex    sync.Mutex
+	nextID   int64
+	users    map[string]*Record // By username
+	sessions map[string]*memorySession
+}
+
+func NewMemory() *Memory {
+	m := new(Memory)
+	m.users = map[string]*Record{}
+	m.sessions = map[string]*memorySession{}
+	return m
+}
+
+func (m *Memory) CreateUser(r *Record) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.users[r.Username]; ok {
+		return ErrExists
+	}
+	m.nextID++
+	r.ID = m.nextID
+	stored := *r
+	m.users[r.Username] = &stored
+	return nil
+}
+
+func (m *Memory) GetUser(username string) (*Record, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r, ok := m.users[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *r
+	return &found, nil
+}
+
+func (m *Memory) ListUsers() ([]User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	list := []User{}
+	for _, r := range m.users {
+		list = append(list, r.User)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
+
+func (m *Memory) DeleteUser(username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r, ok := m.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.users, username)
+	for id, s := range m.sessions {
+		if s.UserID == r.ID {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// byID must be called with the mutex held
+func (m *Memory) byID(userID int64) *Record {
+	for _, r := range m.users {
+		if r.ID == userID {
+			return r
+		}
+	}
+	return nil
+}
+
+func (m *Memory) SetPassword(userID int64, hash string, brokerHash string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if r := m.byID(userID); r != nil {
+		r.PasswordHash = hash
+		r.BrokerPasswordHash = brokerHash
+	}
+	return nil
+}
+
+func (m *Memory) SetBrokerHash(userID int64, passwordHash string, brokerHash string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if r := m.byID(userID); r != nil && r.PasswordHash == passwordHash {
+		r.BrokerPasswordHash = brokerHash
+	}
+	return nil
+}
+
+func (m *Memory) SetLock(userID int64, failedLogins int, lockedUntil *time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if r := m.byID(userID); r != nil {
+		r.FailedLogins = failedLogins
+		r.LockedUntil = nil
+		if lockedUntil != nil {
+			until := *lockedUntil
+			r.LockedUntil = &until
+		}
+	}
+	return nil
+}
+
+func (m *Memory) RecordFailure(userID int64) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := m.byID(userID)
+	if r == nil {
+		return 0, ErrNotFound
+	}
+	r.FailedLogins++
+	return r.FailedLogins, nil
+}
+
+func (m *Memory) CreateSession(s *SessionRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sessions[s.ID] = &memorySession{SessionRecord: *s}
+	return nil
+}
+
+// live must be called with the mutex held
+func (m *Memory) live(id string) *memorySession {
+	s, ok := m.sessions[id]
+	if !ok || s.revoked || !time.Now().Before(s.ExpiresAt) {
+		return nil
+	}
+	return s
+}
+
+func (m *Memory) RefreshSession(id string, refreshHash string, next string, expiresAt time.Time) (*Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := m.live(id)
+	if s == nil || s.RefreshHash != refreshHash {
+		return nil, ErrInvalidSession
+	}
+	r := m.byID(s.UserID)
+	if r == nil {
+		return nil, ErrInvalidSession
+	}
+
+	s.RefreshHash = next
+	s.ExpiresAt = expiresAt
+	s.Username = r.Username
+	s.Role = r.Role
+
+	session := s.Session
+	return &session, nil
+}
+
+func (m *Memory) SessionActive(id string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.live(id) != nil, nil
+}
+
+func (m *Memory) GetSession(id string) (*Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := m.live(id)
+	if s == nil {
+		return nil, ErrInvalidSession
+	}
+	r := m.byID(s.UserID)
+	if r == nil {
+		return nil, ErrInvalidSession
+	}
+
+	session := s.Session
+	session.Username = r.Username
+	session.Role = r.Role
+	return &session, nil
+}
+
+func (m *Memory) RevokeSession(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if s, ok := m.sessions[id]; ok {
+		s.revoked = true
+	}
+	return nil
+}
+
+func (m *Memory) RevokeSessions(userID int64, except string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, s := range m.sessions {
+		if s.UserID == userID && id != except {
+			s.revoked = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type postgres struct {
+	db *sql.DB
+}
+
+// NewPostgres keeps the users in the users and sessions tables
+func NewPostgres(db *sql.DB) Repository {
+	return &postgres{db: db}
+}
+
+func (p *postgres) CreateUser(r *Record) error {
+	err := p.db.QueryRow(`INSERT INTO users (username, password_hash, broker_password_hash, role) VALUES ($1, $2, $3, $4) RETURNING id`,
+		r.Username, r.PasswordHash, r.BrokerPasswordHash, r.Role).Scan(&r.ID)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+		return ErrExists
+	}
+	return err
+}
+
+const userColumns = `id, username, role, broker_password_hash, locked_until`
+
+func scanUser(row interface{ Scan(...any) error }, extra ...any) (*User, error) {
+	var user User
+	var lockedUntil sql.NullTime
+	if err := row.Scan(append([]any{&user.ID, &user.Username, &user.Role, &user.BrokerPasswordHash, &lockedUntil}, extra...)...); err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		user.LockedUntil = &lockedUntil.Time
+	}
+	return &user, nil
+}
+
+func (p *postgres) GetUser(username string) (*Record, error) {
+	var r Record
+	user, err := scanUser(p.db.QueryRow(`SELECT `+userColumns+`, password_hash, failed_logins FROM users WHERE username = $1`, username),
+		&r.PasswordHash, &r.FailedLogins)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.User = *user
+	return &r, nil
+}
+
+func (p *postgres) ListUsers() ([]User, error) {
+
+	rows, err := p.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *user)
+	}
+	return list, rows.Err()
+}
+
+func (p *postgres) DeleteUser(username string) error {
+	result, err := p.db.Exec(`DELETE FROM users WHERE username = $1`, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (p *postgres) SetPassword(userID int64, hash string, brokerHash string) error {
+	_, err := p.db.Exec(`UPDATE users SET password_hash = $2, broker_password_hash = $3, updated_at = now() WHERE id = $1`, userID, hash, brokerHash)
+	return err
+}
+
+func (p *postgres) SetBrokerHash(userID int64, passwordHash string, brokerHash string) error {
+	_, err := p.db.Exec(`UPDATE users SET broker_password_hash = $3, updated_at = now() WHERE id = $1 AND password_hash = $2`, userID, passwordHash, brokerHash)
+	return err
+}
+
+func (p *postgres) SetLock(userID int64, failedLogins int, lockedUntil *time.Time) error {
+	_, err := p.db.Exec(`UPDATE users SET failed_logins = $2, locked_until = $3, updated_at = now() WHERE id = $1`, userID, failedLogins, lockedUntil)
+	return err
+}
+
+func (p *postgres) RecordFailure(userID int64) (int, error) {
+	var failures int
+	err := p.db.QueryRow(`UPDATE users SET failed_logins = failed_logins + 1, updated_at = now() WHERE id = $1 RETURNING failed_logins`, userID).Scan(&failures)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return failures, err
+}
+
+func (p *postgres) CreateSession(s *SessionRecord) error {
+	_, err := p.db.Exec(`INSERT INTO sessions (id, user_id, refresh_hash, client_id, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		s.ID, s.UserID, s.RefreshHash, s.ClientID, s.ExpiresAt)
+	return err
+}
+
+func (p *postgres) RefreshSession(id string, refreshHash string, next string, expiresAt time.Time) (*Session, error) {
+
+	session := &Session{ID: id, ExpiresAt: expiresAt}
+
+	err := p.db.QueryRow(`
+		UPDATE sessions SET refresh_hash = $3, expires_at = $4
+		FROM users
+		WHERE sessions.id = $1 AND sessions.refresh_hash = $2 AND sessions.revoked_at IS NULL AND sessions.expires_at > now()
+		AND users.id = sessions.user_id
+		RETURNING sessions.user_id, users.username, users.role, sessions.client_id`,
+		id, refreshHash, next, expiresAt).Scan(&session.UserID, &session.Username, &session.Role, &session.ClientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (p *postgres) SessionActive(id string) (bool, error) {
+	var active bool
+	err := p.db.QueryRow(`SELECT revoked_at IS NULL AND expires_at > now() FROM sessions WHERE id = $1`, id).Scan(&active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return active, err
+}
+
+func (p *postgres) GetSession(id string) (*Session, error) {
+
+	session := &Session{ID: id}
+
+	err := p.db.QueryRow(`
+		SELECT sessions.user_id, users.username, users.role, sessions.client_id, sessions.expires_at
+		FROM sessions JOIN users ON users.id = sessions.user_id
+		WHERE sessions.id = $1 AND sessions.revoked_at IS NULL AND sessions.expires_at > now()`,
+		id).Scan(&session.UserID, &session.Username, &session.Role, &session.ClientID, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (p *postgres) RevokeSession(id string) error {
+	_, err := p.db.Exec(`UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+	return err
+}
+
+func (p *postgres) RevokeSessions(userID int64, except string) error {
+	_, err := p.db.Exec(`UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL`, userID, except)
+	return err
+}
@@ -0,0 +1,51 @@
+package users
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrExists is returned when a user is created with a username which is already taken
+var ErrExists = errors.New("already exists")
+
+// Record is a user as it is stored, with the password hash and the count of failed logins
+type Record struct {
+	User
+	PasswordHash string
+	FailedLogins int
+}
+
+// SessionRecord is a session as it is stored. Only a hash of the refresh token is kept
+type SessionRecord struct {
+	Session
+	RefreshHash string
+}
+
+// Repository keeps the users and their sessions. The Store holds the rules; a Repository only stores and finds
+type Repository interface {
+	CreateUser(r *Record) error               // Sets the ID. ErrExists if the username is taken
+	GetUser(username string) (*Record, error) // ErrNotFound if there is no such user
+	ListUsers() ([]User, error)               // In order of username
+	DeleteUser(username string) error         // Removes the user's sessions too. ErrNotFound if there is no such user
+	SetPassword(userID int64, hash string, brokerHash string) error
+	SetLock(userID int64, failedLogins int, lockedUntil *time.Time) error
+	RecordFailure(userID int64) (int, error) // Adds one to the failed logins in a single step, and returns the new count
+
+	// SetBrokerHash replaces the broker password hash, provided the password hash is still the one given, so a
+	// password changed in the meantime is not undone
+	SetBrokerHash(userID int64, passwordHash string, brokerHash string) error
+
+	CreateSession(s *SessionRecord) error
+
+	// RefreshSession replaces the refresh hash of a session which has neither expired nor been revoked, provided the
+	// current hash matches, and returns the session. ErrInvalidSession otherwise
+	RefreshSession(id string, refreshHash string, next string, expiresAt time.Time) (*Session, error)
+
+	SessionActive(id string) (bool, error) // False if there is no such session
+
+	// GetSession returns a session which has neither expired nor been revoked, with the current username and role of
+	// its user. ErrInvalidSession otherwise
+	GetSession(id string) (*Session, error)
+	RevokeSession(id string) error
+	RevokeSessions(userID int64, except string) error // Revokes all the user's sessions but one, or all if except is empty
+}
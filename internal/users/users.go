@@ -0,0 +1,322 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/mosquitto"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Indefinitely is the time an account locked by an admin stays locked until
+var Indefinitely = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrLocked             = errors.New("account is locked")
+	ErrNotFound           = errors.New("not found")
+	ErrInvalidSession     = errors.New("session is not valid")
+
+	// ErrTooManyFailures is returned by the failed login which locks the account. It is also an ErrLocked
+	ErrTooManyFailures = fmt.Errorf("too many failed logins: %w", ErrLocked)
+)
+
+type User struct {
+	ID                 int64
+	Username           string
+	Role               string
+	BrokerPasswordHash string // Mosquitto's hash of the password, empty until the password is next set
+	LockedUntil        *time.Time
+}
+
+// Locked reports whether the account is locked at the given time
+func (u *User) Locked(now time.Time) bool {
+	return u.LockedUntil != nil && now.Before(*u.LockedUntil)
+}
+
+type Session struct {
+	ID        string
+	UserID    int64
+	Username  string
+	Role      string
+	ClientID  string
+	ExpiresAt time.Time
+}
+
+// Store keeps the users and their sessions, in whichever repository it is given
+type Store struct {
+	repo            Repository
+	maxFailures     int
+	lockoutDuration time.Duration
+}
+
+func NewStore(repo Repository, c *config.UsersConfig) (*Store, error) {
+
+	lockoutDuration, err := c.GetLockoutDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Store)
+	s.repo = repo
+	s.maxFailures = c.GetMaxFailures()
+	s.lockoutDuration = lockoutDuration
+	return s, nil
+}
+
+func HashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", fmt.Errorf("the password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// hashBrokerPassword hashes the password in the form the broker's password file needs, which cannot be made from
+// the bcrypt hash
+func hashBrokerPassword(password string) (string, error) {
+	salt, err := mosquitto.NewSalt()
+	if err != nil {
+		return "", err
+	}
+	return mosquitto.HashPassword(password, salt), nil
+}
+
+func (s *Store) Create(username string, password string, role string) (*User, error) {
+
+	if username == "" {
+		return nil, fmt.Errorf("the username must not be empty")
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	brokerHash, err := hashBrokerPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{User: User{Username: username, Role: role, BrokerPasswordHash: brokerHash}, PasswordHash: hash}
+	err = s.repo.CreateUser(record)
+	if err != nil {
+		return nil, fmt.Errorf("could not create user '%s': %w", username, err)
+	}
+	return &record.User, nil
+}
+
+// Authenticate checks the user's password. After too many failures in a row the account is locked for a while,
+// and during that time even the right password is refused
+func (s *Store) Authenticate(username string, password string) (*User, error) {
+
+	record, err := s.repo.GetUser(username)
+	if errors.Is(err, ErrNotFound) {
+		// Spend the same time as for a real user, so the response time does not give away which usernames exist
+		_ = bcrypt.CompareHashAndPassword([]byte("$2a$10$0fh7ev1OxPydk9Yd/iJk.OJzzcGdV56l5PV3zaUUlAL3daUm.DT62"), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The password is compared even when the account is locked, so the response time does not give away the lock
+	// before the password has been given. Failures while locked are not counted, so they cannot extend the lock
+	now := time.Now()
+	mismatch := bcrypt.CompareHashAndPassword([]byte(record.PasswordHash), []byte(password)) != nil
+	if record.Locked(now) {
+		return nil, ErrLocked
+	}
+
+	if mismatch {
+		// The count is kept by the repository, so failed logins at the same time are all counted
+		failures, err := s.repo.RecordFailure(record.ID)
+		if err != nil {
+			return nil, err
+		}
+		if failures >= s.maxFailures {
+			until := now.Add(s.lockoutDuration)
+			err = s.repo.SetLock(record.ID, 0, &until)
+			if err != nil {
+				return nil, err
+			}
+			return nil, ErrTooManyFailures
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	err = s.repo.SetLock(record.ID, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Broker hashes made with too few iterations are replaced while the password is at hand
+	if mosquitto.Weak(record.BrokerPasswordHash) {
+		brokerHash, err := hashBrokerPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		err = s.repo.SetBrokerHash(record.ID, record.PasswordHash, brokerHash)
+		if err != nil {
+			return nil, err
+		}
+		record.BrokerPasswordHash = brokerHash
+	}
+
+	user := record.User
+	user.LockedUntil = nil
+	return &user, nil
+}
+
+// ChangePassword sets a new password, once the old one has been checked, and ends the user's other sessions
+func (s *Store) ChangePassword(username string, oldPassword string, newPassword string, keepSession string) error {
+
+	user, err := s.Authenticate(username, oldPassword)
+	if err != nil {
+		return err
+	}
+
+	hash, err := HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	brokerHash, err := hashBrokerPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.SetPassword(user.ID, hash, brokerHash)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.RevokeSessions(user.ID, keepSession)
+}
+
+// List returns all the users, in order of username
+func (s *Store) List() ([]User, error) {
+	return s.repo.ListUsers()
+}
+
+func (s *Store) Get(username string) (*User, error) {
+	record, err := s.repo.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	return &record.User, nil
+}
+
+// Delete removes the user, together with their sessions
+func (s *Store) Delete(username string) error {
+	return s.repo.DeleteUser(username)
+}
+
+// Lock locks the account until the given time, and ends its sessions. A nil time unlocks it
+func (s *Store) Lock(username string, until *time.Time) error {
+
+	user, err := s.Get(username)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.SetLock(user.ID, 0, until)
+	if err != nil {
+		return err
+	}
+
+	if until != nil {
+		err = s.repo.RevokeSessions(user.ID, "")
+	}
+	return err
+}
+
+// CreateSession starts a session for the user, returning it with its refresh token
+func (s *Store) CreateSession(user *User, clientID string, ttl time.Duration) (*Session, string, error) {
+
+	id, err := randomString(16)
+	if err != nil {
+		return nil, "", err
+	}
+
+	refreshToken, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session := &Session{
+		ID:        id,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		ClientID:  clientID,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	err = s.repo.CreateSession(&SessionRecord{Session: *session, RefreshHash: hashToken(refreshToken)})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return session, session.ID + "." + refreshToken, nil
+}
+
+// Refresh swaps a refresh token for a new one, extending the session. Each refresh token can only be used once
+func (s *Store) Refresh(refreshToken string, ttl time.Duration) (*Session, string, error) {
+
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok {
+		return nil, "", ErrInvalidSession
+	}
+
+	next, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session, err := s.repo.RefreshSession(id, hashToken(secret), hashToken(next), time.Now().Add(ttl))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return session, id + "." + next, nil
+}
+
+// Active reports whether the session has neither expired nor been revoked
+func (s *Store) Active(sessionID string) (bool, error) {
+	return s.repo.SessionActive(sessionID)
+}
+
+// Session returns the session if it has neither expired nor been revoked, with the user's current role, which may
+// have changed since the session's tokens were issued
+func (s *Store) Session(sessionID string) (*Session, error) {
+	return s.repo.GetSession(sessionID)
+}
+
+func (s *Store) Revoke(sessionID string) error {
+	return s.repo.RevokeSession(sessionID)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is used to store refresh tokens, which are random enough not to need a slow hash
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
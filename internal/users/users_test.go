@@ -0,0 +1,257 @@
+package users
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rsmaxwell/diaries/internal/config"
+	"github.com/rsmaxwell/diaries/internal/mosquitto"
+)
+
+const password = "correct horse"
+
+func newStore(t *testing.T, repo Repository, c config.UsersConfig) *Store {
+	t.Helper()
+
+	s, err := NewStore(repo, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func createStoreUser(t *testing.T, repo Repository, s *Store) *User {
+	t.Helper()
+
+	user, err := s.Create(username(t, repo, "user"), password, "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		lockout  string
+		attempts []string // Passwords tried before the last
+		wait     time.Duration
+		last     string
+		wantErr  error
+	}{
+		{name: "right password", last: password},
+		{name: "wrong password", last: "wrong", wantErr: ErrInvalidCredentials},
+		{name: "one failure short of the lockout", attempts: []string{"wrong", "wrong"}, last: password},
+		{name: "the failure which locks", attempts: []string{"wrong", "wrong"}, last: "wrong", wantErr: ErrTooManyFailures},
+		{name: "right password while locked", attempts: []string{"wrong", "wrong", "wrong"}, last: password, wantErr: ErrLocked},
+		{name: "wrong password while locked", attempts: []string{"wrong", "wrong", "wrong"}, last: "wrong", wantErr: ErrLocked},
+		{name: "a success starts the count again", attempts: []string{"wrong", "wrong", password, "wrong", "wrong"}, last: password},
+		{name: "the lockout runs out", lockout: "50ms", attempts: []string{"wrong", "wrong", "wrong"}, wait: 100 * time.Millisecond, last: password},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eachBackend(t, func(t *testing.T, repo Repository) {
+
+				s := newStore(t, repo, config.UsersConfig{MaxFailures: 3, LockoutDuration: tt.lockout})
+				user := createStoreUser(t, repo, s)
+
+				for _, attempt := range tt.attempts {
+					_, _ = s.Authenticate(user.Username, attempt)
+				}
+				time.Sleep(tt.wait)
+
+				// Only the failure which locks the account is ErrTooManyFailures, so the errors are compared exactly
+				_, err := s.Authenticate(user.Username, tt.last)
+				if err != tt.wantErr {
+					t.Errorf("Authenticate: %v, want %v", err, tt.wantErr)
+				}
+			})
+		})
+	}
+}
+
+func TestAuthenticateUnknownUser(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo Repository) {
+
+		s := newStore(t, repo, config.UsersConfig{})
+		if _, err := s.Authenticate(unique(t, "nobody"), password); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Authenticate: %v, want %v", err, ErrInvalidCredentials)
+		}
+	})
+}
+
+func TestRefresh(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		token   func(first string, second string) string // The token given to the last refresh
+		wantErr error
+	}{
+		{name: "the new token", ttl: time.Hour, token: func(first, second string) string { return second }},
+		{name: "the used token", ttl: time.Hour, token: func(first, second string) string { return first }, wantErr: ErrInvalidSession},
+		{name: "no secret", ttl: time.Hour, token: func(first, second string) string { return "session" }, wantErr: ErrInvalidSession},
+		{name: "another session", ttl: time.Hour, token: func(first, second string) string { return "other." + second }, wantErr: ErrInvalidSession},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eachBackend(t, func(t *testing.T, repo Repository) {
+
+				s := newStore(t, repo, config.UsersConfig{})
+				user := createStoreUser(t, repo, s)
+
+				session, first, err := s.CreateSession(user, "client-1", tt.ttl)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				refreshed, second, err := s.Refresh(first, tt.ttl)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if refreshed.ID != session.ID || refreshed.ClientID != "client-1" || second == first {
+					t.Errorf("Refresh = %+v, %q; want session %s with a new token", refreshed, second, session.ID)
+				}
+
+				_, _, err = s.Refresh(tt.token(first, second), tt.ttl)
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Refresh: %v, want %v", err, tt.wantErr)
+				}
+			})
+		})
+	}
+}
+
+func TestRefreshExpired(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo Repository) {
+
+		s := newStore(t, repo, config.UsersConfig{})
+		user := createStoreUser(t, repo, s)
+
+		_, token, err := s.CreateSession(user, "client-1", -time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.Refresh(token, time.Hour); !errors.Is(err, ErrInvalidSession) {
+			t.Errorf("Refresh: %v, want %v", err, ErrInvalidSession)
+		}
+	})
+}
+
+func TestRevoke(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		revoke     func(s *Store, user *User, kept string, other string) error
+		wantKept   bool
+		wantOthers bool
+	}{
+		{
+			name:       "one session",
+			revoke:     func(s *Store, user *User, kept, other string) error { return s.Revoke(other) },
+			wantKept:   true,
+			wantOthers: false,
+		},
+		{
+			name: "changing the password keeps the current session",
+			revoke: func(s *Store, user *User, kept, other string) error {
+				return s.ChangePassword(user.Username, password, "battery staple", kept)
+			},
+			wantKept:   true,
+			wantOthers: false,
+		},
+		{
+			name: "locking ends every session",
+			revoke: func(s *Store, user *User, kept, other string) error {
+				until := time.Now().Add(time.Hour)
+				return s.Lock(user.Username, &until)
+			},
+		},
+		{
+			name:   "deleting ends every session",
+			revoke: func(s *Store, user *User, kept, other string) error { return s.Delete(user.Username) },
+		},
+		{
+			name:       "unlocking ends nothing",
+			revoke:     func(s *Store, user *User, kept, other string) error { return s.Lock(user.Username, nil) },
+			wantKept:   true,
+			wantOthers: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eachBackend(t, func(t *testing.T, repo Repository) {
+
+				s := newStore(t, repo, config.UsersConfig{})
+				user := createStoreUser(t, repo, s)
+
+				kept, _, err := s.CreateSession(user, "client-1", time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+				other, token, err := s.CreateSession(user, "client-2", time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := tt.revoke(s, user, kept.ID, other.ID); err != nil {
+					t.Fatal(err)
+				}
+
+				for _, check := range []struct {
+					id   string
+					want bool
+				}{{kept.ID, tt.wantKept}, {other.ID, tt.wantOthers}} {
+					active, err := s.Active(check.id)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if active != check.want {
+						t.Errorf("Active(%s) = %v, want %v", check.id, active, check.want)
+					}
+				}
+
+				// A revoked session cannot be brought back with its refresh token
+				if !tt.wantOthers {
+					if _, _, err := s.Refresh(token, time.Hour); !errors.Is(err, ErrInvalidSession) {
+						t.Errorf("Refresh of a revoked session: %v, want %v", err, ErrInvalidSession)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestAuthenticateReplacesWeakBrokerHash(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo Repository) {
+
+		s := newStore(t, repo, config.UsersConfig{})
+		user := createStoreUser(t, repo, s)
+
+		record, err := repo.GetUser(user.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		weak := "$7$101$c2FsdA==$aGFzaA=="
+		if err := repo.SetBrokerHash(user.ID, record.PasswordHash, weak); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Authenticate(user.Username, password); err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := s.Get(user.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.BrokerPasswordHash == weak || mosquitto.Weak(found.BrokerPasswordHash) {
+			t.Errorf("the broker hash %q was not replaced", found.BrokerPasswordHash)
+		}
+	})
+}
@@ -0,0 +1,7 @@
+@echo off
+
+setlocal
+cd %~dp0
+
+echo on
+AddDiaryRequest.exe -title "Diary 1900"
@@ -0,0 +1,7 @@
+@echo off
+
+setlocal
+cd %~dp0
+
+echo on
+AddPageRequest.exe -diary 1 -title "January"
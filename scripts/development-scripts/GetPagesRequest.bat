@@ -4,4 +4,4 @@ setlocal
 cd %~dp0
 
 echo on
-GetPagesRequest.exe
+GetPagesRequest.exe -diary 1
@@ -0,0 +1,8 @@
+@echo off
+
+setlocal
+cd %~dp0
+
+echo on
+Migrate.exe up
+Migrate.exe status
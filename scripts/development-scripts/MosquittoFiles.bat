@@ -0,0 +1,7 @@
+@echo off
+
+setlocal
+cd %~dp0
+
+echo on
+MosquittoFiles.exe -passwords password_file -acl acl_file
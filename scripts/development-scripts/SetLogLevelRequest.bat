@@ -0,0 +1,7 @@
+@echo off
+
+setlocal
+cd %~dp0
+
+echo on
+SetLogLevelRequest.exe -component mqtt -level debug
@@ -0,0 +1,7 @@
+@echo off
+
+setlocal
+cd %~dp0
+
+echo on
+ShareDiaryRequest.exe -diary 1 -username richard -access read